@@ -4,4 +4,8 @@ go 1.25.0
 
 require github.com/noclaps/applause v0.3.10
 
-require github.com/melbahja/got v0.7.0
+require (
+	github.com/klauspost/compress v1.18.0
+	github.com/melbahja/got v0.7.0
+	github.com/ulikunitz/xz v0.5.15
+)
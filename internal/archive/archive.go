@@ -0,0 +1,365 @@
+// Package archive extracts downloaded archives natively, without depending on
+// tar or unzip being installed on the host.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+type Options struct {
+	// Leading path components to remove from every entry, like tar's
+	// --strip-components
+	StripComponents int
+	// Patterns matched against entries after stripping. A pattern that matches
+	// a directory includes everything in it. Everything is extracted if empty.
+	Include []string
+}
+
+// The compression format of an archive, detected from its first bytes
+type format int
+
+const (
+	formatTar format = iota
+	formatGzip
+	formatXz
+	formatBzip2
+	formatZstd
+	formatZip
+)
+
+var magics = []struct {
+	magic  []byte
+	format format
+}{
+	{[]byte{0x1f, 0x8b}, formatGzip},
+	{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, formatXz},
+	{[]byte("BZh"), formatBzip2},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, formatZstd},
+	{[]byte("PK\x03\x04"), formatZip},
+}
+
+// Extracts the archive at src into dest. Supports zip files and tar files that
+// are uncompressed or compressed with gzip, xz, bzip2 or zstd. Entries that
+// would be written outside dest are refused.
+func Extract(ctx context.Context, src, dest string, opts Options) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("Error opening %s: %v\n", src, err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	header, _ := r.Peek(6)
+	detected := formatTar
+	for _, m := range magics {
+		if bytes.HasPrefix(header, m.magic) {
+			detected = m.format
+			break
+		}
+	}
+
+	if err := os.MkdirAll(dest, 0o755); err != nil {
+		return fmt.Errorf("Error creating %s: %v\n", dest, err)
+	}
+	// every write goes through root, so that links extracted earlier can't
+	// redirect later entries outside dest
+	root, err := os.OpenRoot(dest)
+	if err != nil {
+		return fmt.Errorf("Error opening %s: %v\n", dest, err)
+	}
+	defer root.Close()
+	x := extractor{ctx: ctx, dest: dest, root: root, opts: opts}
+
+	var tr io.Reader
+	switch detected {
+	case formatZip:
+		info, err := f.Stat()
+		if err != nil {
+			return fmt.Errorf("Error reading %s: %v\n", src, err)
+		}
+		zr, err := zip.NewReader(f, info.Size())
+		if err != nil {
+			return fmt.Errorf("Error reading zip file %s: %v\n", src, err)
+		}
+		return x.zip(zr)
+	case formatGzip:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("Error reading gzip file %s: %v\n", src, err)
+		}
+		defer gr.Close()
+		tr = gr
+	case formatXz:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("Error reading xz file %s: %v\n", src, err)
+		}
+		tr = xr
+	case formatBzip2:
+		tr = bzip2.NewReader(r)
+	case formatZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("Error reading zstd file %s: %v\n", src, err)
+		}
+		defer zr.Close()
+		tr = zr
+	default:
+		tr = r
+	}
+	if err := x.tar(tar.NewReader(tr)); err != nil {
+		return fmt.Errorf("Error extracting %s: %v\n", src, err)
+	}
+	return nil
+}
+
+type extractor struct {
+	ctx  context.Context
+	dest string
+	root *os.Root
+	opts Options
+}
+
+func (x extractor) tar(tr *tar.Reader) error {
+	for {
+		if err := x.ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name, ok, err := x.target(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = x.dir(name)
+		case tar.TypeReg:
+			err = x.file(name, tr, hdr.FileInfo().Mode())
+		case tar.TypeSymlink:
+			err = x.symlink(name, hdr.Linkname)
+		case tar.TypeLink:
+			err = x.hardlink(name, hdr.Linkname)
+		default:
+			// devices, fifos and the like have no place in a package
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (x extractor) zip(zr *zip.Reader) error {
+	for _, zf := range zr.File {
+		if err := x.ctx.Err(); err != nil {
+			return err
+		}
+		name, ok, err := x.target(zf.Name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		mode := zipMode(name, zf)
+		switch {
+		case mode.IsDir():
+			err = x.dir(name)
+		case mode&fs.ModeSymlink != 0:
+			err = x.zipSymlink(name, zf)
+		case mode.IsRegular():
+			err = x.zipFile(name, zf, mode)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The systems that made a zip file whose entries have Unix permissions
+const (
+	creatorUnix   = 3
+	creatorMacOSX = 19
+)
+
+// Returns the mode to extract a zip entry with. Zip files made on other
+// systems, such as Windows, have no Unix permissions, so regular files in a bin
+// directory are made executable.
+func zipMode(name string, zf *zip.File) fs.FileMode {
+	mode := zf.Mode()
+	creator := zf.CreatorVersion >> 8
+	if creator == creatorUnix || creator == creatorMacOSX || !mode.IsRegular() {
+		return mode
+	}
+	if slices.Contains(strings.Split(path.Dir(name), "/"), "bin") {
+		return 0o755
+	}
+	return mode
+}
+
+func (x extractor) zipFile(name string, zf *zip.File, mode fs.FileMode) error {
+	rc, err := zf.Open()
+	if err != nil {
+		return fmt.Errorf("Error reading %s: %v", zf.Name, err)
+	}
+	defer rc.Close()
+	return x.file(name, rc, mode)
+}
+
+func (x extractor) zipSymlink(name string, zf *zip.File) error {
+	rc, err := zf.Open()
+	if err != nil {
+		return fmt.Errorf("Error reading %s: %v", zf.Name, err)
+	}
+	defer rc.Close()
+	target, err := io.ReadAll(io.LimitReader(rc, 4096))
+	if err != nil {
+		return fmt.Errorf("Error reading %s: %v", zf.Name, err)
+	}
+	return x.symlink(name, string(target))
+}
+
+// Returns the path an entry should be extracted to relative to dest, after
+// stripping leading components, and whether it should be extracted at all.
+// Entries that would escape dest are an error.
+func (x extractor) target(entry string) (string, bool, error) {
+	entry = strings.ReplaceAll(entry, `\`, "/")
+	if path.IsAbs(entry) || hasDotDot(entry) {
+		return "", false, fmt.Errorf("Refusing to extract %s, which is outside the destination", entry)
+	}
+
+	parts := strings.FieldsFunc(path.Clean(entry), func(r rune) bool { return r == '/' })
+	if len(parts) > 0 && parts[0] == "." {
+		parts = parts[1:]
+	}
+	if len(parts) <= x.opts.StripComponents {
+		return "", false, nil
+	}
+	name := path.Join(parts[x.opts.StripComponents:]...)
+
+	if len(x.opts.Include) == 0 {
+		return name, true, nil
+	}
+	for _, pattern := range x.opts.Include {
+		// a pattern matching a directory includes everything in it
+		for p := name; p != "."; p = path.Dir(p) {
+			if ok, _ := path.Match(pattern, p); ok {
+				return name, true, nil
+			}
+		}
+	}
+	return "", false, nil
+}
+
+func hasDotDot(p string) bool {
+	return strings.Contains("/"+p+"/", "/../")
+}
+
+// The path of an entry in dest, for messages
+func (x extractor) path(name string) string {
+	return filepath.Join(x.dest, filepath.FromSlash(name))
+}
+
+func (x extractor) dir(name string) error {
+	if err := x.root.MkdirAll(filepath.FromSlash(name), 0o755); err != nil {
+		return fmt.Errorf("Error creating %s: %v", x.path(name), err)
+	}
+	return nil
+}
+
+func (x extractor) file(name string, r io.Reader, mode fs.FileMode) error {
+	dest := x.path(name)
+	if err := x.prepare(name); err != nil {
+		return err
+	}
+
+	// only keep the permission bits, never setuid and the like
+	f, err := x.root.OpenFile(filepath.FromSlash(name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm()|0o200)
+	if err != nil {
+		return fmt.Errorf("Error creating %s: %v", dest, err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("Error writing %s: %v", dest, err)
+	}
+	return f.Close()
+}
+
+func (x extractor) symlink(name, target string) error {
+	// links may only point at other files being extracted, so that later
+	// entries can't be written through them to somewhere outside dest
+	resolved := path.Join(path.Dir(name), filepath.ToSlash(target))
+	if filepath.IsAbs(target) || resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return fmt.Errorf("Refusing to extract link %s -> %s, which points outside the destination", name, target)
+	}
+
+	dest := x.path(name)
+	if err := x.prepare(name); err != nil {
+		return err
+	}
+	if err := x.root.Symlink(target, filepath.FromSlash(name)); err != nil {
+		return fmt.Errorf("Error creating link %s: %v", dest, err)
+	}
+	return nil
+}
+
+func (x extractor) hardlink(name, target string) error {
+	target, ok, err := x.target(target)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("Cannot extract %s, which is a link to %s, as %s is not being extracted", name, target, target)
+	}
+
+	dest := x.path(name)
+	if err := x.prepare(name); err != nil {
+		return err
+	}
+	if err := x.root.Link(filepath.FromSlash(target), filepath.FromSlash(name)); err != nil {
+		return fmt.Errorf("Error creating link %s: %v", dest, err)
+	}
+	return nil
+}
+
+// Creates the parent directories of an entry and removes anything already
+// there, so that archives can overwrite their own entries
+func (x extractor) prepare(name string) error {
+	if err := x.root.MkdirAll(filepath.FromSlash(path.Dir(name)), 0o755); err != nil {
+		return fmt.Errorf("Error creating %s: %v", filepath.Dir(x.path(name)), err)
+	}
+	if err := x.root.Remove(filepath.FromSlash(name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error replacing %s: %v", x.path(name), err)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package archive
+
+import (
+	"archive/tar"
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A chain of links that each point inside dest on their own, but together lead
+// outside it
+func TestExtractRefusesLinkChainsOutOfDest(t *testing.T) {
+	base := t.TempDir()
+	dest := filepath.Join(base, "a", "b", "c")
+	src := filepath.Join(base, "evil.tar")
+
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	for _, link := range [][2]string{{"s2", "."}, {"evil", "s2/.."}, {"evil/s2", "."}, {"e2", "evil/s2/../.."}} {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: link[0], Linkname: link[1], Mode: 0o777}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := []byte("pwned\n")
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "e2/PWNED", Mode: 0o644, Size: int64(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Extract(context.Background(), src, dest, Options{}); err == nil {
+		t.Fatal("Extract succeeded, expected it to refuse the link chain")
+	}
+
+	filepath.WalkDir(base, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.Name() == "PWNED" {
+			t.Errorf("PWNED was written to %s", path)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,190 @@
+// Package cache stores downloaded files in PKG_HOME/cache, keyed by their
+// sha256 checksum, so that the same file is only ever downloaded once.
+package cache
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg-mngr/pkg/internal/config"
+)
+
+// A file in the cache. Each file is stored as cache/<sha256>/<filename>, and
+// the modification time of its directory records when it was last used.
+type Entry struct {
+	Sha256   string
+	Filename string
+	Size     int64
+	LastUsed time.Time
+}
+
+var checksumPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Returns the directory the file with the checksum is cached in, or an error
+// if the checksum isn't a sha256 checksum
+func dir(shasum string) (string, error) {
+	shasum = strings.ToLower(shasum)
+	if !checksumPattern.MatchString(shasum) {
+		return "", fmt.Errorf("Invalid sha256 checksum %q\n", shasum)
+	}
+	return filepath.Join(config.PKG_CACHE, shasum), nil
+}
+
+// Places the cached file with the checksum at dest, returning false if it
+// isn't cached. The file still has to be verified, since anything could have
+// changed it since it was cached.
+func Get(shasum, dest string) (bool, error) {
+	d, err := dir(shasum)
+	if err != nil {
+		return false, err
+	}
+	entries, err := os.ReadDir(d)
+	if os.IsNotExist(err) || (err == nil && len(entries) == 0) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Error reading cache: %v\n", err)
+	}
+
+	if err := link(filepath.Join(d, entries[0].Name()), dest); err != nil {
+		return false, err
+	}
+	now := time.Now()
+	os.Chtimes(d, now, now)
+	return true, nil
+}
+
+// Whether the file with the checksum is cached
+func Has(shasum string) bool {
+	d, err := dir(shasum)
+	if err != nil {
+		return false
+	}
+	entries, err := os.ReadDir(d)
+	return err == nil && len(entries) > 0
+}
+
+// Adds a downloaded and verified file to the cache
+func Put(shasum, src string) error {
+	d, err := dir(shasum)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(d); err != nil {
+		return fmt.Errorf("Error removing %s: %v\n", d, err)
+	}
+	if err := os.MkdirAll(d, 0o755); err != nil {
+		return fmt.Errorf("Error creating %s: %v\n", d, err)
+	}
+	return link(src, filepath.Join(d, filepath.Base(src)))
+}
+
+// Removes the file with the checksum from the cache, such as when it no longer
+// matches its checksum
+func Evict(shasum string) error {
+	d, err := dir(shasum)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(d); err != nil {
+		return fmt.Errorf("Error removing %s: %v\n", d, err)
+	}
+	return nil
+}
+
+// Lists every file in the cache, most recently used first
+func List() ([]Entry, error) {
+	dirs, err := os.ReadDir(config.PKG_CACHE)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading cache: %v\n", err)
+	}
+
+	entries := []Entry{}
+	for _, d := range dirs {
+		if !d.IsDir() || !checksumPattern.MatchString(d.Name()) {
+			continue
+		}
+		dirInfo, err := d.Info()
+		if err != nil {
+			return nil, fmt.Errorf("Error reading cache: %v\n", err)
+		}
+		files, err := os.ReadDir(filepath.Join(config.PKG_CACHE, d.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("Error reading cache: %v\n", err)
+		}
+		for _, file := range files {
+			info, err := file.Info()
+			if err != nil {
+				return nil, fmt.Errorf("Error reading cache: %v\n", err)
+			}
+			entries = append(entries, Entry{
+				Sha256:   d.Name(),
+				Filename: file.Name(),
+				Size:     info.Size(),
+				LastUsed: dirInfo.ModTime(),
+			})
+		}
+	}
+
+	slices.SortFunc(entries, func(a, b Entry) int { return b.LastUsed.Compare(a.LastUsed) })
+	return entries, nil
+}
+
+// Removes every file that hasn't been used for longer than age, and returns
+// the removed files
+func Prune(age time.Duration) ([]Entry, error) {
+	entries, err := List()
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []Entry{}
+	cutoff := time.Now().Add(-age)
+	for _, entry := range entries {
+		if entry.LastUsed.After(cutoff) {
+			continue
+		}
+		if err := Evict(entry.Sha256); err != nil {
+			return removed, err
+		}
+		removed = append(removed, entry)
+	}
+	return removed, nil
+}
+
+// Removes every file in the cache, and returns the removed files
+func Clean() ([]Entry, error) {
+	return Prune(0)
+}
+
+// Hard links src to dest, falling back to copying it when they're on different
+// filesystems
+func link(src, dest string) error {
+	if err := os.Link(src, dest); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("Error reading %s: %v\n", src, err)
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return fmt.Errorf("Error creating %s: %v\n", dest, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("Error copying %s to %s: %v\n", src, dest, err)
+	}
+	return out.Close()
+}
@@ -0,0 +1,14 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+)
+
+type ErrorOffline struct {
+	Missing []string
+}
+
+func (e ErrorOffline) Error() string {
+	return fmt.Sprintf("Cannot continue offline, the following have not been cached yet:\n  %s", strings.Join(e.Missing, "\n  "))
+}
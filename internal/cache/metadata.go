@@ -0,0 +1,54 @@
+package cache
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg-mngr/pkg/internal/config"
+)
+
+// Manifests and other files from manifest hosts are cached in cache/manifests,
+// mirroring their urls, so that they can be read offline
+func metadataPath(rawUrl string) (string, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("Invalid url %s\n", rawUrl)
+	}
+	return filepath.Join(config.PKG_CACHE, "manifests", u.Host, filepath.Clean("/"+u.Path)), nil
+}
+
+// Reads the cached copy of the file at url, returning ErrorOffline if it isn't
+// cached
+func GetMetadata(url string) ([]byte, error) {
+	path, err := metadataPath(url)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrorOffline{Missing: []string{url}}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading cached %s: %v\n", url, err)
+	}
+	return data, nil
+}
+
+// Caches the contents of the file at url
+func PutMetadata(url string, data []byte) error {
+	path, err := metadataPath(url)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("Error creating %s: %v\n", filepath.Dir(path), err)
+	}
+	// written to a temporary file first, so that another pkg process reading
+	// it never sees half a file
+	if err := config.WriteFileAtomic(path, data); err != nil {
+		return fmt.Errorf("Error caching %s: %v\n", url, err)
+	}
+	return nil
+}
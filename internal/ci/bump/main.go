@@ -1,9 +1,8 @@
 package main
 
 import (
-	"crypto/sha256"
+	"context"
 	"encoding/json"
-	"fmt"
 	"os"
 	"path"
 	"path/filepath"
@@ -61,18 +60,11 @@ func main() {
 
 				log.Printf("Fetching file from %s\n", url)
 				filename := filepath.Join(config.PKG_TMP, path.Base(url))
-				if err := util.Fetch(url, filename, pkgManifest.Name); err != nil {
+				checksum, err := util.Fetch(context.Background(), url, filename, pkgManifest.Name)
+				if err != nil {
 					log.Errorf("Error fetching from %s: %v\n", url, err)
 					return
 				}
-
-				data, err := os.ReadFile(filename)
-				if err != nil {
-					log.Errorf("Error reading data from %s: %v\n", filename, err)
-				}
-
-				log.Printf("Validating checksum for %s\n", path.Base(url))
-				checksum := fmt.Sprintf("%x", sha256.Sum256(data))
 				pkgManifest.Sha256[platform] = checksum
 			}
 
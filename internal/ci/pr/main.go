@@ -24,7 +24,7 @@ func main() {
 
 	for _, file := range files {
 		log.Printf("Checking if installation works...\n")
-		if err := cmd.Add("./"+file, true, lockfile); err != nil {
+		if err := cmd.Add([]string{"./" + file}, true, false, false, lockfile); err != nil {
 			errPu := manifest.ErrorPackageUnsupported{}
 			switch {
 			case errors.As(err, &errPu):
@@ -1,163 +1,482 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"maps"
 	"os"
 	"path"
 	"path/filepath"
 	"slices"
 	"strings"
 
+	"github.com/pkg-mngr/pkg/internal/archive"
+	"github.com/pkg-mngr/pkg/internal/cache"
 	"github.com/pkg-mngr/pkg/internal/config"
 	"github.com/pkg-mngr/pkg/internal/log"
 	"github.com/pkg-mngr/pkg/internal/manifest"
 	"github.com/pkg-mngr/pkg/internal/util"
+	"github.com/pkg-mngr/pkg/internal/version"
 )
 
-func Add(pkg string, skipConfirmation bool, lockfile config.Lockfile) error {
-	pkgManifest, err := manifest.Get(pkg)
-	if err != nil {
-		return err
+// Installs packages and their dependencies. Their manifests are fetched at
+// once, as are their downloads, before each package is installed along with
+// its dependencies in a transaction of its own, so a package that fails to
+// install doesn't undo the ones installed before it. Packages that can't be
+// found or aren't supported are skipped, and returned as ErrorPackagesSkipped
+// once the rest are installed. With dryRun, prints what would be installed
+// instead, recording it only in the in-memory lockfile.
+func Add(pkgs []string, skipConfirmation, overwrite, dryRun bool, lockfile config.Lockfile) error {
+	fetched := util.ParallelMap(pkgs, config.JOBS, func(pkg string, _ int) manifestFetch {
+		pkgManifest, err := manifest.Get(pkg)
+		return manifestFetch{Name: pkg, Manifest: pkgManifest, Err: err}
+	})
+
+	skipped := []error{}
+	roots := []manifest.Manifest{}
+	// the packages installed alongside the versions already installed
+	keepPrevious := map[string]bool{}
+	for _, fetch := range fetched {
+		errPnf := manifest.ErrorPackageNotFound{}
+		errPu := manifest.ErrorPackageUnsupported{}
+		switch {
+		case errors.As(fetch.Err, &errPnf), errors.As(fetch.Err, &errPu):
+			skipped = append(skipped, fetch.Err)
+			continue
+		case fetch.Err != nil:
+			return fetch.Err
+		}
+		if slices.ContainsFunc(roots, func(root manifest.Manifest) bool { return root.Name == fetch.Manifest.Name }) {
+			continue
+		}
+
+		install, keep, err := requestInstall(fetch.Name, fetch.Manifest, dryRun, lockfile)
+		if err != nil {
+			return err
+		}
+		if install {
+			roots = append(roots, fetch.Manifest)
+			keepPrevious[fetch.Manifest.Name] = keep
+		}
+	}
+	if len(roots) == 0 {
+		return skippedErr(skipped)
 	}
-	pkg = pkgManifest.Name
 
-	if entry, ok := lockfile[pkg]; ok {
-		wasDep := false
-		for installed, data := range lockfile {
-			// if package was installed as a dependency, remove it from the dependency
-			// list of all those packages
-			if i := slices.Index(data.Dependencies, pkg); i != -1 {
-				data.Dependencies = slices.Delete(data.Dependencies, i, i+1)
-				lockfile[installed] = data
-				wasDep = true
+	plans := []plan{}
+	for _, root := range roots {
+		// a dry run plans any upgrades of dependencies without asking
+		rootPlan, err := resolve([]manifest.Manifest{root}, lockfile, skipConfirmation || dryRun)
+		if err != nil {
+			return err
+		}
+		rootPlan.print()
+		if !dryRun {
+			if err := rootPlan.checkOffline(); err != nil {
+				return err
 			}
 		}
+		plans = append(plans, rootPlan)
+	}
 
-		if wasDep || entry.Version == pkgManifest.Version {
-			log.Printf("%s is already installed", pkg)
-			return nil
+	failed := map[string]error{}
+	if !dryRun {
+		var err error
+		if failed, err = prefetch(plans...); err != nil {
+			return err
 		}
 	}
 
-	fmt.Printf("Installing %s...\n", pkg)
+	before := lockfile.Clone()
+	for _, rootPlan := range plans {
+		// earlier plans may have installed some of this one already
+		rootPlan = rootPlan.refresh(lockfile).requested(keepPrevious)
+		if len(rootPlan) == 0 {
+			continue
+		}
+		if dryRun {
+			rootPlan.dryRun(lockfile)
+			continue
+		}
+		if err := rootPlan.prefetchErr(failed); err != nil {
+			return err
+		}
 
-	filename := filepath.Join(config.PKG_TMP, path.Base(pkgManifest.Url))
+		// if any package in the plan fails to install, none of them are kept
+		err := withTransaction(lockfile, func(tx *transaction) error {
+			tx.overwrite = overwrite
+			return rootPlan.install(tx, skipConfirmation)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if dryRun {
+		printLockfileDiff(before, lockfile)
+	}
+	return skippedErr(skipped)
+}
 
-	// download from url
-	err = util.Fetch(pkgManifest.Url, filename, pkgManifest.Name)
+// Marks the requested packages in a plan as explicitly installed, keeping the
+// versions already installed of those installed alongside them
+func (p plan) requested(keepPrevious map[string]bool) plan {
+	for i, node := range p {
+		keep, requested := keepPrevious[node.Manifest.Name]
+		if !requested {
+			continue
+		}
+		p[i].KeepPrevious = keep
+		// asking for a package by name makes it explicitly installed, even if
+		// another requested package depends on it
+		p[i].Dependent = ""
+		if previous := node.Previous; previous != nil {
+			explicit := *previous
+			explicit.Reason = config.ReasonExplicit
+			p[i].Previous = &explicit
+		}
+	}
+	return p
+}
+
+func skippedErr(skipped []error) error {
+	if len(skipped) == 0 {
+		return nil
+	}
+	return ErrorPackagesSkipped{Errs: skipped}
+}
+
+// Works out whether a requested package needs to be installed, and whether
+// alongside the versions that are already installed. Packages that don't need
+// to be installed are switched to the requested version, or marked as
+// explicitly installed, instead.
+func requestInstall(pkg string, pkgManifest manifest.Manifest, dryRun bool, lockfile config.Lockfile) (install, keepPrevious bool, err error) {
+	_, requestedVersion := manifest.SplitVersion(pkg)
+	pkg = pkgManifest.Name
+
+	// a specific version is installed alongside whichever versions are already
+	// installed, and becomes the active one
+	entry, ok := lockfile[pkg]
+	if !ok {
+		return true, false, nil
+	}
+	if requestedVersion != "" && entry.Version != pkgManifest.Version {
+		if slices.Contains(entry.Versions, pkgManifest.Version) {
+			log.Printf("%s %s is already installed\n", pkg, pkgManifest.Version)
+			if dryRun {
+				fmt.Printf("Would switch %s from %s to %s\n", pkg, entry.Version, pkgManifest.Version)
+				return false, false, nil
+			}
+			return false, false, Switch(pkg, pkgManifest.Version, lockfile)
+		}
+		if len(entry.Versions) == 0 {
+			log.Printf("Replacing %s %s with %s\n", pkg, entry.Version, pkgManifest.Version)
+			return true, false, nil
+		}
+		log.Printf("Installing %s %s alongside %s\n", pkg, pkgManifest.Version, strings.Join(entry.Versions, ", "))
+		return true, true, nil
+	}
+
+	// a package installed as a dependency is now wanted for itself
+	if entry.Reason == config.ReasonDependency {
+		log.Printf("%s is already installed, marking it as explicitly installed\n", pkg)
+		before := lockfile.Clone()
+		entry.Reason = config.ReasonExplicit
+		lockfile[pkg] = entry
+		if dryRun {
+			printLockfileDiff(before, lockfile)
+			return false, false, nil
+		}
+		return false, false, lockfile.Write()
+	}
+	if version.Compare(entry.Version, pkgManifest.Version) == 0 {
+		log.Printf("%s is already installed\n", pkg)
+		return false, false, nil
+	}
+	if version.Compare(entry.Version, pkgManifest.Version) > 0 {
+		log.Printf("%s %s is already installed, which is newer than %s\n", pkg, entry.Version, pkgManifest.Version)
+		return false, false, nil
+	}
+	return true, false, nil
+}
+
+// Templates the package's manifest with the directories it's installed into,
+// and downloads and verifies its file into its working directory
+func download(tx *transaction, pkgManifest *manifest.Manifest) error {
+	dirs, err := tx.stage(pkgManifest.Name, pkgManifest.Version)
 	if err != nil {
 		return err
 	}
+	*pkgManifest = pkgManifest.WithDirs(dirs)
+
+	filename := filepath.Join(dirs.Tmp, path.Base(pkgManifest.Url))
 
-	// verify checksum
-	err = util.VerifyChecksum(filename, pkgManifest.Sha256, pkgManifest.Name)
+	cached, err := cache.Get(pkgManifest.Sha256, filename)
 	if err != nil {
 		return err
 	}
+	if cached {
+		fmt.Println("Using cached download")
+		err := util.VerifyChecksum(filename, pkgManifest.Sha256, pkgManifest.Name)
+		if err == nil {
+			return nil
+		}
+		// the cached file has been changed since it was cached, and has been
+		// quarantined
+		log.Errorf("%v\n", err)
+		log.Printf("Cached download of %s is corrupt, downloading it again\n", pkgManifest.Name)
+		if err := cache.Evict(pkgManifest.Sha256); err != nil {
+			return err
+		}
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Error removing %s: %v\n", filename, err)
+		}
+	}
 
-	if err := install(lockfile, pkgManifest, skipConfirmation); err != nil {
+	// download from url, then verify its checksum
+	checksum, err := util.Fetch(tx.ctx, pkgManifest.Url, filename, pkgManifest.Name)
+	if err != nil {
+		return tx.interruptedOr(err)
+	}
+	if err := util.CompareChecksum(filename, pkgManifest.Sha256, checksum, pkgManifest.Name); err != nil {
 		return err
 	}
-	fmt.Printf("Finished installing %s\n", pkg)
+	fmt.Println("Checksum looks good!")
 
+	// failing to cache the download only means it has to be downloaded again
+	// next time
+	if err := cache.Put(pkgManifest.Sha256, filename); err != nil {
+		log.Errorf("Error caching download of %s: %v", pkgManifest.Name, err)
+	}
 	return nil
 }
 
-func listFiles() ([]string, error) {
-	files := []string{}
-	pkgDirs := map[string]string{
-		config.PKG_BIN:             "bin",
-		config.PKG_OPT:             "opt",
-		config.PKG_ZSH_COMPLETIONS: "share/zsh/site-functions",
-	}
-	for dir, dirName := range pkgDirs {
-		entries, err := os.ReadDir(dir)
-		if err != nil {
-			return nil, fmt.Errorf("Error listing %s directory: %v", dir, err)
+// Runs the extract steps of a package, which may only extract into its prefix
+// or working directory
+func extract(tx *transaction, pkgManifest manifest.Manifest) error {
+	workDir := tx.workDir(pkgManifest.Name)
+	filename := filepath.Join(workDir, path.Base(pkgManifest.Url))
+	for _, step := range pkgManifest.Extract {
+		if !isWithin(step.To, versionPrefix(pkgManifest.Name, pkgManifest.Version)) && !isWithin(step.To, workDir) {
+			return fmt.Errorf("Cannot extract to %s, which is outside the package's directories", step.To)
 		}
-		for _, entry := range entries {
-			files = append(files, filepath.Join(dirName, entry.Name()))
+		if step.StripComponents < 0 {
+			return fmt.Errorf("Invalid strip_components %d", step.StripComponents)
 		}
-	}
 
-	return files, nil
+		fmt.Printf("Extracting %s...\n", path.Base(pkgManifest.Url))
+		opts := archive.Options{StripComponents: step.StripComponents, Include: step.Include}
+		if err := archive.Extract(tx.ctx, filename, step.To, opts); err != nil {
+			return tx.interruptedOr(err)
+		}
+	}
+	return nil
 }
 
-func diffFiles(before, after []string) []string {
-	diff := []string{}
-	for _, item := range after {
-		if !slices.Contains(before, item) {
-			diff = append(diff, item)
+// Creates the links declared in a package's manifest in its prefix,
+// pointing at files in its opt directory. They're linked into PKG_HOME along
+// with everything else in the prefix's bin, man and completions directories
+// when the version is activated.
+func createLinks(tx *transaction, pkgManifest manifest.Manifest) error {
+	root := versionPrefix(pkgManifest.Name, pkgManifest.Version)
+	groups := []struct {
+		patterns []string
+		dir      func(file string) (string, error)
+	}{
+		{pkgManifest.Links.Bin, func(string) (string, error) { return "bin", nil }},
+		{pkgManifest.Links.Man, manSection},
+		{pkgManifest.Links.ZshCompletions, func(string) (string, error) { return "share/zsh/site-functions", nil }},
+	}
+
+	for _, group := range groups {
+		for _, pattern := range group.patterns {
+			if filepath.IsAbs(pattern) || slices.Contains(strings.Split(filepath.ToSlash(pattern), "/"), "..") {
+				return fmt.Errorf("Cannot link %s, which is outside the package's opt directory", pattern)
+			}
+			matches, err := filepath.Glob(filepath.Join(root, "opt", pattern))
+			if err != nil || len(matches) == 0 {
+				return fmt.Errorf("Cannot link %s, no files match it in the package's opt directory", pattern)
+			}
+
+			for _, match := range matches {
+				dir, err := group.dir(match)
+				if err != nil {
+					return err
+				}
+				dir = filepath.Join(root, dir)
+				if err := os.MkdirAll(dir, 0o755); err != nil {
+					return fmt.Errorf("Error creating %s: %v\n", dir, err)
+				}
+				link := filepath.Join(dir, filepath.Base(match))
+				target, _ := filepath.Rel(dir, match)
+				if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+					return fmt.Errorf("Error replacing %s: %v\n", link, err)
+				}
+				if err := os.Symlink(target, link); err != nil {
+					return fmt.Errorf("Error creating link %s: %v\n", link, err)
+				}
+			}
 		}
 	}
+	return nil
+}
 
-	return diff
+// Returns the directory a man page is linked into, from the section directory
+// it's in, such as man1, or otherwise its extension, such as .1
+func manSection(file string) (string, error) {
+	if section := filepath.Base(filepath.Dir(file)); strings.HasPrefix(section, "man") && len(section) > 3 {
+		return filepath.Join("share/man", section), nil
+	}
+	if ext := strings.TrimPrefix(filepath.Ext(file), "."); ext != "" && ext[0] >= '0' && ext[0] <= '9' {
+		return filepath.Join("share/man", "man"+ext[:1]), nil
+	}
+	return "", fmt.Errorf("Cannot link man page %s, as its section can't be worked out from its directory or extension", filepath.Base(file))
 }
 
-func install(lockfile config.Lockfile, pkgManifest manifest.Manifest, skipConfirmation bool) error {
-	// skip adding dependencies that are already installed. these were installed
-	// either due to some other package or manually by the user, so they're not
-	// lockfile dependencies of this package
-	dependencies := slices.DeleteFunc(pkgManifest.Dependencies, func(dep string) bool {
-		_, ok := lockfile[dep]
-		return ok
-	})
-	if len(dependencies) > 0 {
-		fmt.Println("Installing dependencies...")
-		for _, dep := range dependencies {
-			// add dependencies before in case they're needed for installation of
-			// current package
-			Add(dep, skipConfirmation, lockfile)
+// Whether file is dir or inside it
+func isWithin(file, dir string) bool {
+	rel, err := filepath.Rel(dir, file)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// Installs a downloaded package into PKG_HOME, replacing the previous version
+// if it's being updated. Its dependencies must already be installed.
+func install(tx *transaction, node planNode, skipConfirmation bool) error {
+	pkgManifest := node.Manifest
+	prefix := versionPrefix(pkgManifest.Name, pkgManifest.Version)
+
+	versions := []string{}
+	previousFiles := []string{}
+	pin := ""
+	reason := config.ReasonExplicit
+	if node.Dependent != "" {
+		reason = config.ReasonDependency
+	}
+	if node.Previous != nil {
+		previousFiles = config.Roots(node.Previous.Files)
+		pin = node.Previous.Pin
+		reason = node.Previous.Reason
+		versions = slices.Clone(node.Previous.Versions)
+		if len(node.Previous.Versions) == 0 {
+			// installed before versions could be installed side by side, so its
+			// opt directory has to make way for the new prefix
+			for _, file := range previousFiles {
+				if err := tx.backup(file); err != nil {
+					return err
+				}
+			}
+			previousFiles = nil
 		}
 	}
 
-	// list files before installation
-	filesBefore, err := listFiles()
-	if err != nil {
+	// run install and completions scripts in the prefix the package is
+	// installed into, with its bin directory on the PATH so completions can be
+	// generated by the new binaries
+	if err := tx.place(pkgManifest.Name, pkgManifest.Version); err != nil {
 		return err
 	}
+	env := []string{fmt.Sprintf("PATH=%s:%s", filepath.Join(prefix, "bin"), os.Getenv("PATH"))}
+	workDir := tx.workDir(pkgManifest.Name)
 
-	// run install and completions scripts
-	fmt.Println("Running install script...")
-	installScript := strings.Join(pkgManifest.Scripts.Install, "\n")
-	_, err = util.RunScript(installScript, skipConfirmation)
-	if err != nil {
+	if err := extract(tx, pkgManifest); err != nil {
 		return err
 	}
+	if len(pkgManifest.Scripts.Install) != 0 {
+		fmt.Println("Running install script...")
+		installScript := strings.Join(pkgManifest.Scripts.Install, "\n")
+		if _, err := util.RunScriptIn(tx.ctx, installScript, workDir, env, skipConfirmation); err != nil {
+			return tx.interruptedOr(err)
+		}
+	}
 	if len(pkgManifest.Scripts.Completions) != 0 {
 		fmt.Println("Running completions script...")
 		completionsScript := strings.Join(pkgManifest.Scripts.Completions, "\n")
-		_, err := util.RunScript(completionsScript, skipConfirmation)
-		if err != nil {
+		if _, err := util.RunScriptIn(tx.ctx, completionsScript, workDir, env, skipConfirmation); err != nil {
+			return tx.interruptedOr(err)
+		}
+	}
+	if err := tx.check(); err != nil {
+		return err
+	}
+	if err := createLinks(tx, pkgManifest); err != nil {
+		return err
+	}
+
+	// move the version being replaced out of the way, unless it's being kept
+	// alongside the new one
+	if node.Previous != nil && len(node.Previous.Versions) != 0 && !node.KeepPrevious && node.Previous.Version != pkgManifest.Version {
+		if err := tx.backup(filepath.Join("opt", pkgManifest.Name, node.Previous.Version)); err != nil {
 			return err
 		}
+		versions = slices.DeleteFunc(versions, func(v string) bool { return v == node.Previous.Version })
+	}
+	// files belonging to other packages are only replaced with --overwrite
+	installedFiles, err := linkedFiles(prefix)
+	if err != nil {
+		return err
+	}
+	overwritten := map[string]string{}
+	if node.Previous != nil {
+		maps.Copy(overwritten, node.Previous.Overwritten)
 	}
+	claimed, err := tx.claim(pkgManifest.Name, append(installedFiles, filepath.Join("opt", pkgManifest.Name)))
+	if err != nil {
+		return err
+	}
+	maps.Copy(overwritten, claimed)
 
-	// list files after installation
-	filesAfter, err := listFiles()
+	files, links, err := tx.activate(pkgManifest.Name, pkgManifest.Version, previousFiles)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(versions, pkgManifest.Version) {
+		versions = append(versions, pkgManifest.Version)
+	}
+	slices.SortFunc(versions, version.Compare)
+	var previousRecords []config.File
+	if node.Previous != nil {
+		previousRecords = node.Previous.Files
+	}
+	records, err := recordFiles(pkgManifest.Name, files, previousRecords, pkgManifest.Version)
 	if err != nil {
 		return err
 	}
 
 	// add to lockfile
-	lockfile[pkgManifest.Name] = config.LockfilePackage{
+	constraints := map[string]string{}
+	for dep, depConstraints := range pkgManifest.Constraints {
+		constraints[dep] = depConstraints.String()
+	}
+	tx.lockfile[pkgManifest.Name] = config.LockfilePackage{
 		Manifest:     pkgManifest.ManifestUrl,
 		Version:      pkgManifest.Version,
-		Dependencies: dependencies,
-		Files:        diffFiles(filesBefore, filesAfter),
-	}
-
-	// delete and recreate .pkg/tmp
-	if err := os.RemoveAll(config.PKG_TMP); err != nil {
-		return fmt.Errorf("Error deleting %s: %v\n", config.PKG_TMP, err)
+		Versions:     versions,
+		Dependencies: node.Dependencies,
+		Constraints:  constraints,
+		Links:        links,
+		Overwritten:  overwritten,
+		Reason:       reason,
+		Pin:          pin,
+		Files:        records,
 	}
-	if err := os.Mkdir(config.PKG_TMP, 0o755); err != nil {
-		return fmt.Errorf("Error creating %s: %v\n", config.PKG_TMP, err)
+	// packages that were broken by removing this one with --force are whole
+	// again
+	for name, entry := range tx.lockfile {
+		if slices.Contains(entry.Broken, pkgManifest.Name) {
+			entry.Broken = slices.DeleteFunc(slices.Clone(entry.Broken), func(dep string) bool { return dep == pkgManifest.Name })
+			tx.lockfile[name] = entry
+		}
 	}
 
-	if pkgManifest.Caveats != "" {
-		fmt.Printf("\nCaveats:\n %s\n\n", pkgManifest.Caveats)
+	// caveats were templated with the transaction's working directory, which is
+	// gone once it finishes
+	if caveats := pkgManifest.WithDirs(installDirs(pkgManifest)).Caveats; caveats != "" {
+		fmt.Printf("\nCaveats:\n %s\n\n", caveats)
 	}
 
 	return nil
 }
+
+// The directories a package is installed into, for templating its manifest
+func installDirs(pkgManifest manifest.Manifest) manifest.Dirs {
+	return manifest.DirsIn(versionPrefix(pkgManifest.Name, pkgManifest.Version), config.PKG_TMP)
+}
@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg-mngr/pkg/internal/cache"
+	"github.com/pkg-mngr/pkg/internal/config"
+	"github.com/pkg-mngr/pkg/internal/util"
+)
+
+// Lists the files in the download cache, most recently used first
+func CacheList() ([]string, error) {
+	entries, err := cache.List()
+	if err != nil {
+		return nil, err
+	}
+	return util.Map(entries, func(entry cache.Entry, i int) string {
+		return fmt.Sprintf("\033[1m%s:\033[0m %s, last used %s\n  sha256: %s",
+			entry.Filename, formatSize(entry.Size), entry.LastUsed.Format(time.DateTime), entry.Sha256)
+	}), nil
+}
+
+// Removes every file from the download cache, along with the downloads that
+// were quarantined for not matching their checksums
+func CacheClean() error {
+	removed, err := cache.Clean()
+	printRemoved(removed)
+	if err != nil {
+		return err
+	}
+	return cleanQuarantine()
+}
+
+func cleanQuarantine() error {
+	count, total := 0, int64(0)
+	err := filepath.WalkDir(config.PKG_QUARANTINE, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if info, err := d.Info(); err == nil && info.Mode().IsRegular() {
+			count++
+			total += info.Size()
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading %s: %v\n", config.PKG_QUARANTINE, err)
+	}
+
+	fmt.Printf("Deleting %s...\n", config.PKG_QUARANTINE)
+	if err := os.RemoveAll(config.PKG_QUARANTINE); err != nil {
+		return fmt.Errorf("Error removing %s: %v\n", config.PKG_QUARANTINE, err)
+	}
+	fmt.Printf("Removed %d quarantined files, freeing %s\n", count, formatSize(total))
+	return nil
+}
+
+// Removes the files in the download cache that haven't been used for longer
+// than olderThan, such as 30d or 12h
+func CachePrune(olderThan string) error {
+	age, err := parseAge(olderThan)
+	if err != nil {
+		return err
+	}
+	removed, err := cache.Prune(age)
+	printRemoved(removed)
+	return err
+}
+
+func printRemoved(removed []cache.Entry) {
+	total := int64(0)
+	for _, entry := range removed {
+		fmt.Printf("Deleting %s...\n", entry.Filename)
+		total += entry.Size
+	}
+	fmt.Printf("Removed %d files, freeing %s\n", len(removed), formatSize(total))
+}
+
+// Parses an age such as 30d, in addition to everything time.ParseDuration
+// accepts
+func parseAge(age string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(age, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("Invalid age %q, expected something like 30d or 12h", age)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(age)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("Invalid age %q, expected something like 30d or 12h", age)
+	}
+	return d, nil
+}
+
+func formatSize(size int64) string {
+	switch {
+	case size >= 1024*1024*1024:
+		return fmt.Sprintf("%.2f GB", float64(size)/1024/1024/1024)
+	case size >= 1024*1024:
+		return fmt.Sprintf("%.2f MB", float64(size)/1024/1024)
+	case size >= 1024:
+		return fmt.Sprintf("%.2f kB", float64(size)/1024)
+	}
+	return fmt.Sprintf("%d B", size)
+}
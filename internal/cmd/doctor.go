@@ -0,0 +1,454 @@
+package cmd
+
+import (
+	"fmt"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg-mngr/pkg/internal/config"
+	"github.com/pkg-mngr/pkg/internal/manifest"
+)
+
+// The result of one of the checks run by Doctor
+type DoctorCheck struct {
+	Name     string
+	Problems []string
+	// How to fix the problems, if --fix can't
+	Hint string
+	// Whether the problems were fixed with --fix
+	Fixed bool
+}
+
+func (c DoctorCheck) String() string {
+	if len(c.Problems) == 0 {
+		return fmt.Sprintf("\033[32m✓\033[0m %s", c.Name)
+	}
+	status := "\033[31m✗\033[0m"
+	if c.Fixed {
+		status = "\033[33m✓\033[0m"
+	}
+	output := fmt.Sprintf("%s %s", status, c.Name)
+	for _, problem := range c.Problems {
+		output += fmt.Sprintf("\n    %s", strings.ReplaceAll(problem, "\n", "\n    "))
+	}
+	if c.Fixed {
+		output += "\n    \033[33mFixed\033[0m"
+	} else if c.Hint != "" {
+		output += "\n    " + strings.ReplaceAll(c.Hint, "\n", "\n    ")
+	}
+	return output
+}
+
+// Checks the setup of pkg and PKG_HOME for problems, fixing the ones that can
+// be fixed safely if fix is set. fix must only be set while holding the lock
+// on PKG_HOME.
+func Doctor(fix bool) ([]DoctorCheck, error) {
+	checks := []DoctorCheck{checkLayout(fix), checkPath(), checkFpath()}
+
+	lockfile, err := config.ReadLockfile()
+	if err != nil {
+		hint := "Restore it from a backup, or run `pkg --init` to create an empty one"
+		checks = append(checks, DoctorCheck{Name: "Lockfile", Problems: []string{strings.TrimSpace(err.Error())}, Hint: hint})
+		return append(checks, checkTmp(fix), checkHosts(nil)), nil
+	}
+
+	changed := false
+	for _, check := range []func(bool, config.Lockfile) (DoctorCheck, bool, error){checkBrokenLinks, checkMissingFiles} {
+		result, modified, err := check(fix, lockfile)
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, result)
+		changed = changed || modified
+	}
+	unowned, err := checkUnowned(lockfile)
+	if err != nil {
+		return nil, err
+	}
+	checks = append(checks, unowned)
+	if changed {
+		if err := lockfile.Write(); err != nil {
+			return nil, err
+		}
+	}
+
+	return append(checks, checkTmp(fix), checkHosts(lockfile)), nil
+}
+
+// Checks that the directories pkg installs into exist, creating them if not,
+// and that no interrupted command needs to be finished or undone
+func checkLayout(fix bool) DoctorCheck {
+	check := DoctorCheck{Name: "PKG_HOME layout", Hint: "Run `pkg doctor --fix` or `pkg --init` to create them"}
+	missing := []string{}
+	// problems that --fix can't fix
+	unfixable := []string{}
+	for _, dir := range []string{config.PKG_HOME, config.PKG_BIN, config.PKG_OPT, config.PKG_TMP, config.PKG_CACHE, config.PKG_ZSH_COMPLETIONS} {
+		info, err := os.Stat(dir)
+		switch {
+		case os.IsNotExist(err):
+			check.Problems = append(check.Problems, fmt.Sprintf("%s is missing", dir))
+			missing = append(missing, dir)
+		case err != nil:
+			unfixable = append(unfixable, fmt.Sprintf("Error reading %s: %v", dir, err))
+			check.Problems = append(check.Problems, unfixable[len(unfixable)-1])
+			check.Hint = ""
+		case !info.IsDir():
+			unfixable = append(unfixable, fmt.Sprintf("%s is not a directory", dir))
+			check.Problems = append(check.Problems, unfixable[len(unfixable)-1])
+			check.Hint = "Move it out of the way and run `pkg --init`"
+		}
+	}
+	_, err := os.Stat(config.JOURNAL)
+	interrupted := err == nil
+	if interrupted {
+		check.Problems = append(check.Problems, "A previous pkg command was interrupted and hasn't been finished or undone")
+		check.Hint = "Run `pkg doctor --fix` to finish or undo it"
+	}
+
+	if !fix || len(missing) == 0 && !interrupted {
+		return check
+	}
+	for _, dir := range missing {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			check.Problems = append(check.Problems, fmt.Sprintf("Error creating %s: %v", dir, err))
+			check.Hint = ""
+			return check
+		}
+	}
+	if interrupted {
+		if err := config.RecoverJournal(); err != nil {
+			check.Problems = append(check.Problems, strings.TrimSpace(err.Error()))
+			check.Hint = ""
+			return check
+		}
+	}
+	// only the problems that couldn't be fixed are left to report
+	if len(unfixable) > 0 {
+		check.Problems = unfixable
+		return check
+	}
+	check.Fixed = true
+	return check
+}
+
+// Checks that PKG_BIN is on PATH, and that its binaries aren't shadowed by
+// others earlier on PATH
+func checkPath() DoctorCheck {
+	check := DoctorCheck{Name: "PATH", Hint: "Add the following to your ~/.zshrc:\nexport PATH=\"$PKG_HOME/bin:$PATH\""}
+	if !onPath(os.Getenv("PATH"), config.PKG_BIN) {
+		check.Problems = append(check.Problems, fmt.Sprintf("%s is not on your PATH", config.PKG_BIN))
+		return check
+	}
+
+	entries, _ := os.ReadDir(config.PKG_BIN)
+	for _, entry := range entries {
+		found, err := exec.LookPath(entry.Name())
+		if err != nil || sameDir(filepath.Dir(found), config.PKG_BIN) {
+			continue
+		}
+		check.Problems = append(check.Problems, fmt.Sprintf("%s runs %s instead of the one in %s", entry.Name(), found, config.PKG_BIN))
+	}
+	if len(check.Problems) > 0 {
+		check.Hint = "Move $PKG_HOME/bin before the other directories on your PATH in your ~/.zshrc:\nexport PATH=\"$PKG_HOME/bin:$PATH\""
+	}
+	return check
+}
+
+// Checks that the completions directory is on FPATH, which zsh only exports if
+// it's been exported explicitly
+func checkFpath() DoctorCheck {
+	check := DoctorCheck{Name: "FPATH", Hint: "Add the following to your ~/.zshrc:\nexport FPATH=\"$PKG_HOME/share/zsh/site-functions:$FPATH\""}
+	if !onPath(os.Getenv("FPATH"), config.PKG_ZSH_COMPLETIONS) {
+		check.Problems = append(check.Problems, fmt.Sprintf("%s is not on your FPATH", config.PKG_ZSH_COMPLETIONS))
+	}
+	return check
+}
+
+func onPath(path, dir string) bool {
+	return slices.ContainsFunc(filepath.SplitList(path), func(entry string) bool { return sameDir(entry, dir) })
+}
+
+func sameDir(a, b string) bool {
+	if filepath.Clean(a) == filepath.Clean(b) {
+		return true
+	}
+	a, errA := filepath.EvalSymlinks(a)
+	b, errB := filepath.EvalSymlinks(b)
+	return errA == nil && errB == nil && a == b
+}
+
+// Checks for links in the directories linked into PKG_HOME whose targets are
+// gone. Links that don't belong to any package are removed.
+func checkBrokenLinks(fix bool, lockfile config.Lockfile) (DoctorCheck, bool, error) {
+	check := DoctorCheck{Name: "Broken links"}
+	owners := owners(lockfile)
+	// links that belong to packages, and ones that don't and can be removed
+	owned, unowned := []string{}, []string{}
+	unownedPaths := []string{}
+	brokenOwners := []string{}
+	for _, pattern := range linkedDirs {
+		dirs, _ := filepath.Glob(filepath.Join(config.PKG_HOME, pattern))
+		for _, dir := range dirs {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				return check, false, fmt.Errorf("Error listing %s directory: %v\n", dir, err)
+			}
+			for _, entry := range entries {
+				path := filepath.Join(dir, entry.Name())
+				if entry.Type()&fs.ModeSymlink == 0 {
+					continue
+				}
+				if _, err := os.Stat(path); err == nil {
+					continue
+				}
+				file, _ := filepath.Rel(config.PKG_HOME, path)
+				target, _ := os.Readlink(path)
+				if owner := ownerOf(file, owners); owner != "" {
+					owned = append(owned, fmt.Sprintf("%s -> %s (belongs to %s)", file, target, owner))
+					if !slices.Contains(brokenOwners, owner) {
+						brokenOwners = append(brokenOwners, owner)
+					}
+				} else {
+					unowned = append(unowned, fmt.Sprintf("%s -> %s", file, target))
+					unownedPaths = append(unownedPaths, path)
+				}
+			}
+		}
+	}
+
+	check.Problems = slices.Concat(owned, unowned)
+	if len(brokenOwners) > 0 {
+		check.Hint = fmt.Sprintf("Reinstall the packages they belong to with `pkg verify --repair %s`", strings.Join(brokenOwners, " "))
+	} else if len(unowned) > 0 {
+		check.Hint = "Run `pkg doctor --fix` to remove them"
+	}
+	if !fix || len(unowned) == 0 {
+		return check, false, nil
+	}
+	for _, path := range unownedPaths {
+		if err := os.Remove(path); err != nil {
+			return check, false, fmt.Errorf("Error removing %s: %v\n", path, err)
+		}
+	}
+	// only the links that couldn't be removed are left to report
+	if len(owned) > 0 {
+		check.Problems = owned
+	}
+	check.Fixed = len(owned) == 0
+	return check, false, nil
+}
+
+// Checks for installed packages whose files are gone. Packages that have none
+// of their files left are removed from the lockfile.
+func checkMissingFiles(fix bool, lockfile config.Lockfile) (DoctorCheck, bool, error) {
+	check := DoctorCheck{Name: "Installed packages"}
+	// packages with none of their files left, and ones with some missing
+	gone, damaged := []string{}, []string{}
+	goneProblems, damagedProblems := []string{}, []string{}
+	for _, pkg := range slices.Sorted(maps.Keys(lockfile)) {
+		files := lockfile[pkg].Files
+		missing := 0
+		for _, file := range files {
+			if _, err := os.Lstat(filepath.Join(config.PKG_HOME, file.Path)); os.IsNotExist(err) {
+				missing++
+			}
+		}
+		switch {
+		case missing == 0:
+			continue
+		case missing == len(files):
+			goneProblems = append(goneProblems, fmt.Sprintf("%s: all of its files are gone", pkg))
+			gone = append(gone, pkg)
+		default:
+			damagedProblems = append(damagedProblems, fmt.Sprintf("%s: %d of its %d files are missing", pkg, missing, len(files)))
+			damaged = append(damaged, pkg)
+		}
+	}
+
+	check.Problems = slices.Concat(damagedProblems, goneProblems)
+	if len(damaged) > 0 {
+		check.Hint = fmt.Sprintf("Reinstall them with `pkg verify --repair %s`", strings.Join(slices.Concat(damaged, gone), " "))
+	} else if len(gone) > 0 {
+		check.Hint = fmt.Sprintf("Run `pkg doctor --fix` to remove them from the lockfile, or reinstall them with `pkg verify --repair %s`", strings.Join(gone, " "))
+	}
+	if !fix || len(gone) == 0 {
+		return check, false, nil
+	}
+	for _, pkg := range gone {
+		lockfile.Remove(pkg)
+	}
+	// only the packages that couldn't be fixed are left to report
+	if len(damaged) > 0 {
+		check.Problems = damagedProblems
+		check.Hint = fmt.Sprintf("Reinstall them with `pkg verify --repair %s`", strings.Join(damaged, " "))
+	}
+	check.Fixed = len(damaged) == 0
+	return check, true, nil
+}
+
+// Checks for files in PKG_HOME that don't belong to any installed package
+func checkUnowned(lockfile config.Lockfile) (DoctorCheck, error) {
+	check := DoctorCheck{Name: "Unowned files", Hint: "Remove them, or reinstall the packages they came from with --overwrite to take them over"}
+	roots := slices.Collect(maps.Keys(owners(lockfile)))
+	// pkg's own files and directories
+	ignored := []string{config.PKG_TMP, config.PKG_CACHE, config.PKG_QUARANTINE, config.LOCKFILE, config.LOCKFILE_BACKUP, config.JOURNAL, config.PID_FILE}
+	layout := []string{"bin", "opt", "share", "share/zsh", "share/zsh/site-functions", "share/man", "share/man/*"}
+
+	err := filepath.WalkDir(config.PKG_HOME, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == config.PKG_HOME {
+			return nil
+		}
+		if slices.Contains(ignored, path) {
+			return skip(d)
+		}
+		file, _ := filepath.Rel(config.PKG_HOME, path)
+		if slices.ContainsFunc(roots, func(root string) bool { return isWithin(file, root) }) {
+			return skip(d)
+		}
+		// directories that contain files of installed packages
+		if slices.ContainsFunc(roots, func(root string) bool { return isWithin(root, file) }) {
+			return nil
+		}
+		if slices.ContainsFunc(layout, func(pattern string) bool { ok, _ := filepath.Match(pattern, file); return ok }) {
+			return nil
+		}
+		check.Problems = append(check.Problems, file)
+		return skip(d)
+	})
+	if err != nil {
+		return check, fmt.Errorf("Error reading %s: %v\n", config.PKG_HOME, err)
+	}
+	return check, nil
+}
+
+func skip(d fs.DirEntry) error {
+	if d.IsDir() {
+		return fs.SkipDir
+	}
+	return nil
+}
+
+// Returns the top-level files of every installed package, and the packages
+// they belong to
+func owners(lockfile config.Lockfile) map[string]string {
+	owners := map[string]string{}
+	for pkg, entry := range lockfile {
+		for _, root := range config.Roots(entry.Files) {
+			owners[root] = pkg
+		}
+	}
+	return owners
+}
+
+func ownerOf(file string, owners map[string]string) string {
+	for root, owner := range owners {
+		if isWithin(file, root) {
+			return owner
+		}
+	}
+	return ""
+}
+
+// Checks for anything left in the temporary directory by pkg commands that
+// didn't finish, which is only safe to remove while no other pkg command is
+// running. Transaction directories are kept while the journal of an
+// interrupted command exists, since they hold the files needed to undo it.
+func checkTmp(fix bool) DoctorCheck {
+	check := DoctorCheck{Name: "Temporary files", Hint: "Run `pkg doctor --fix` to remove them"}
+	if pid := config.LockHolder(); pid != 0 && pid != os.Getpid() {
+		return check
+	}
+	entries, err := os.ReadDir(config.PKG_TMP)
+	if err != nil {
+		return check
+	}
+	_, err = os.Stat(config.JOURNAL)
+	interrupted := err == nil
+
+	removable, kept := []string{}, []string{}
+	for _, entry := range entries {
+		path := filepath.Join(config.PKG_TMP, entry.Name())
+		if interrupted && strings.HasPrefix(entry.Name(), "txn-") {
+			kept = append(kept, fmt.Sprintf("%s is kept, as it's needed to finish or undo an interrupted pkg command", path))
+			continue
+		}
+		removable = append(removable, path)
+		check.Problems = append(check.Problems, fmt.Sprintf("%s is left over from a previous run", path))
+	}
+	check.Problems = append(check.Problems, kept...)
+	if len(kept) > 0 {
+		check.Hint = "Finish or undo the interrupted command first, see PKG_HOME layout"
+	}
+	if !fix || len(removable) == 0 {
+		return check
+	}
+	for _, path := range removable {
+		if err := os.RemoveAll(path); err != nil {
+			check.Problems = append(check.Problems, fmt.Sprintf("Error removing %s: %v", path, err))
+			check.Hint = ""
+			return check
+		}
+	}
+	// only the directories that couldn't be removed are left to report
+	if len(kept) > 0 {
+		check.Problems = kept
+		return check
+	}
+	check.Fixed = true
+	return check
+}
+
+// Checks that the manifest host, and the hosts installed packages came from,
+// can be reached
+func checkHosts(lockfile config.Lockfile) DoctorCheck {
+	check := DoctorCheck{Name: "Manifest hosts", Hint: "Check your network connection and PKG_MANIFEST_HOST"}
+	if config.OFFLINE {
+		return check
+	}
+
+	// one url to try for each host
+	urls := map[string]string{}
+	for _, rawUrl := range append([]string{config.MANIFEST_HOST + "/index.json"}, slices.Sorted(maps.Keys(manifestUrls(lockfile)))...) {
+		if u, err := url.Parse(rawUrl); err == nil && u.Host != "" {
+			if _, ok := urls[u.Host]; !ok {
+				urls[u.Host] = rawUrl
+			}
+		}
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	for _, host := range slices.Sorted(maps.Keys(urls)) {
+		res, err := client.Get(urls[host])
+		if err != nil {
+			check.Problems = append(check.Problems, fmt.Sprintf("%s is unreachable: %v", host, err))
+			continue
+		}
+		res.Body.Close()
+		if res.StatusCode >= 400 {
+			check.Problems = append(check.Problems, fmt.Sprintf("%s returned %s for %s", host, res.Status, urls[host]))
+		}
+	}
+	return check
+}
+
+// Returns the remote manifest urls of installed packages
+func manifestUrls(lockfile config.Lockfile) map[string]bool {
+	urls := map[string]bool{}
+	for _, entry := range lockfile {
+		if !manifest.IsLocalFile(entry.Manifest) {
+			urls[entry.Manifest] = true
+		}
+	}
+	return urls
+}
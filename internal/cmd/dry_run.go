@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/pkg-mngr/pkg/internal/cache"
+	"github.com/pkg-mngr/pkg/internal/config"
+	"github.com/pkg-mngr/pkg/internal/util"
+	"github.com/pkg-mngr/pkg/internal/version"
+)
+
+// Prints what installing the plan would download and run, and records the
+// packages it would install in lockfile, without touching PKG_HOME
+func (p plan) dryRun(lockfile config.Lockfile) {
+	for _, node := range p {
+		pkgManifest := node.Manifest.WithDirs(installDirs(node.Manifest))
+		fmt.Printf("\033[1m%s %s:\033[0m\n", pkgManifest.Name, pkgManifest.Version)
+		download := pkgManifest.Url
+		if cache.Has(pkgManifest.Sha256) {
+			download += " (cached)"
+		}
+		fmt.Printf("  Download: %s\n", download)
+		fmt.Printf("  Sha256: %s\n", pkgManifest.Sha256)
+		for _, step := range pkgManifest.Extract {
+			fmt.Printf("  Extract: %s to %s\n", path.Base(pkgManifest.Url), step.To)
+		}
+		printScript("Install script", pkgManifest.Scripts.Install)
+		printScript("Completions script", pkgManifest.Scripts.Completions)
+		fmt.Println()
+
+		lockfile[pkgManifest.Name] = node.lockfileEntry()
+		for name, entry := range lockfile {
+			if slices.Contains(entry.Broken, pkgManifest.Name) {
+				entry.Broken = slices.DeleteFunc(slices.Clone(entry.Broken), func(dep string) bool { return dep == pkgManifest.Name })
+				lockfile[name] = entry
+			}
+		}
+	}
+}
+
+func printScript(name string, script []string) {
+	if len(script) == 0 {
+		return
+	}
+	fmt.Printf("  %s:\n", name)
+	for _, line := range script {
+		fmt.Printf("    %s\n", util.SyntaxHighlight(line))
+	}
+}
+
+// Returns the lockfile entry that installing the node would write, apart from
+// its files, which aren't known until it's installed
+func (node planNode) lockfileEntry() config.LockfilePackage {
+	entry := config.LockfilePackage{Reason: config.ReasonExplicit}
+	if node.Dependent != "" {
+		entry.Reason = config.ReasonDependency
+	}
+	if node.Previous != nil {
+		entry = *node.Previous
+		entry.Versions = slices.Clone(entry.Versions)
+		if len(entry.Versions) == 0 || (!node.KeepPrevious && entry.Version != node.Manifest.Version) {
+			entry.Versions = slices.DeleteFunc(entry.Versions, func(v string) bool { return v == entry.Version })
+		}
+	}
+	entry.Manifest = node.Manifest.ManifestUrl
+	entry.Version = node.Manifest.Version
+	if !slices.Contains(entry.Versions, entry.Version) {
+		entry.Versions = append(entry.Versions, entry.Version)
+	}
+	slices.SortFunc(entry.Versions, version.Compare)
+	entry.Dependencies = node.Dependencies
+	entry.Constraints = map[string]string{}
+	for dep, constraints := range node.Manifest.Constraints {
+		entry.Constraints[dep] = constraints.String()
+	}
+	return entry
+}
+
+// Prints the changes between two versions of the lockfile
+func printLockfileDiff(before, after config.Lockfile) {
+	lines := []string{}
+	names := slices.Sorted(maps.Keys(after))
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		old, wasInstalled := before[name]
+		entry, installed := after[name]
+		switch {
+		case !wasInstalled:
+			lines = append(lines, fmt.Sprintf("\033[32m+ %s %s (%s)\033[0m", name, entry.Version, entry.Reason))
+		case !installed:
+			lines = append(lines, fmt.Sprintf("\033[31m- %s %s\033[0m", name, old.Version))
+		default:
+			changes := entryChanges(old, entry)
+			if len(changes) > 0 {
+				lines = append(lines, fmt.Sprintf("\033[33m~ %s: %s\033[0m", name, strings.Join(changes, ", ")))
+			}
+		}
+	}
+
+	fmt.Println("\033[32;1m===\033[0;1m Lockfile changes\033[0m")
+	if len(lines) == 0 {
+		fmt.Println("  None")
+	}
+	for _, line := range lines {
+		fmt.Printf("  %s\n", line)
+	}
+	fmt.Println()
+}
+
+// Describes how a package's lockfile entry changed, apart from its files
+func entryChanges(old, entry config.LockfilePackage) []string {
+	changes := []string{}
+	change := func(field, from, to string) {
+		if from != to {
+			changes = append(changes, fmt.Sprintf("%s %s -> %s", field, orNone(from), orNone(to)))
+		}
+	}
+	change("version", old.Version, entry.Version)
+	change("versions", strings.Join(old.Versions, " "), strings.Join(entry.Versions, " "))
+	change("dependencies", strings.Join(old.Dependencies, " "), strings.Join(entry.Dependencies, " "))
+	change("reason", old.Reason, entry.Reason)
+	change("broken", strings.Join(old.Broken, " "), strings.Join(entry.Broken, " "))
+	change("pin", old.Pin, entry.Pin)
+	return changes
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
@@ -1,6 +1,14 @@
 package cmd
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/pkg-mngr/pkg/internal/version"
+)
 
 type ErrorPackageNotInstalled struct {
 	Name string
@@ -11,9 +19,118 @@ func (e ErrorPackageNotInstalled) Error() string {
 }
 
 type ErrorPackageDependencyOf struct {
-	Name, Dependent string
+	Name string
+	// Every package that depends on it, directly or indirectly
+	Dependents []string
 }
 
 func (e ErrorPackageDependencyOf) Error() string {
-	return fmt.Sprintf("Cannot uninstall %s as it is a dependency of %s", e.Name, e.Dependent)
+	return fmt.Sprintf("Cannot uninstall %s as other packages depend on it: %s\nUse --cascade to remove them too, or --force to remove it anyway",
+		e.Name, strings.Join(e.Dependents, ", "))
+}
+
+type ErrorRemoveCancelled struct{}
+
+func (e ErrorRemoveCancelled) Error() string {
+	return "Cancelled, nothing was removed"
+}
+
+type ErrorVersionNotInstalled struct {
+	Name, Version string
+	Installed     []string
+}
+
+func (e ErrorVersionNotInstalled) Error() string {
+	return fmt.Sprintf("%s %s is not installed, installed versions are: %s\nInstall it with `pkg add %s@%s`",
+		e.Name, e.Version, strings.Join(e.Installed, ", "), e.Name, e.Version)
+}
+
+type ErrorVersionActive struct {
+	Name, Version string
+}
+
+func (e ErrorVersionActive) Error() string {
+	return fmt.Sprintf("Cannot remove %s %s as it is the active version, switch to another version first or remove %s entirely", e.Name, e.Version, e.Name)
+}
+
+type ErrorFileConflict struct {
+	Name string
+	// Conflicting files and the packages they belong to
+	Conflicts map[string]string
+}
+
+func (e ErrorFileConflict) Error() string {
+	output := fmt.Sprintf("Cannot install %s, as files it would install belong to other packages:", e.Name)
+	for _, file := range slices.Sorted(maps.Keys(e.Conflicts)) {
+		output += fmt.Sprintf("\n  %s (belongs to %s)", file, e.Conflicts[file])
+	}
+	return output + "\nUse --overwrite to take them over"
+}
+
+// Requested packages that were skipped, as they can't be found or aren't
+// supported on this platform, while the rest were installed
+type ErrorPackagesSkipped struct {
+	Errs []error
+}
+
+func (e ErrorPackagesSkipped) Error() string {
+	return errors.Join(e.Errs...).Error()
+}
+
+func (e ErrorPackagesSkipped) Unwrap() []error {
+	return e.Errs
+}
+
+type ErrorInterrupted struct{}
+
+func (e ErrorInterrupted) Error() string {
+	return "Interrupted, all changes have been rolled back"
+}
+
+type ErrorDependency struct {
+	Name, Dependent string
+	Err             error
+}
+
+func (e ErrorDependency) Error() string {
+	return fmt.Sprintf("Cannot install %s, a dependency of %s: %v", e.Name, e.Dependent, e.Err)
+}
+
+type ErrorDependencyCycle struct {
+	Cycle []string
+}
+
+func (e ErrorDependencyCycle) Error() string {
+	return fmt.Sprintf("Dependency cycle detected: %s", strings.Join(e.Cycle, " -> "))
+}
+
+// A version constraint that a package places on one of its dependencies, or
+// that a package is pinned to
+type Requirement struct {
+	Dependent   string
+	Constraints version.Constraints
+	Pinned      bool
+}
+
+type ErrorDependencyConstraint struct {
+	Name, Version string
+	Requirements  []Requirement
+}
+
+func (e ErrorDependencyConstraint) Error() string {
+	output := fmt.Sprintf("%s %s does not satisfy the version requirements:", e.Name, e.Version)
+	if len(e.Requirements) > 1 {
+		output = fmt.Sprintf("Conflicting version requirements for %s %s:", e.Name, e.Version)
+	}
+	for _, req := range e.Requirements {
+		if req.Pinned {
+			output += fmt.Sprintf("\n  %s is pinned to %s", e.Name, req.Constraints)
+		} else {
+			output += fmt.Sprintf("\n  %s requires %s %s", req.Dependent, e.Name, req.Constraints)
+		}
+		if !req.Constraints.Check(e.Version) {
+			output += " (not satisfied)"
+		}
+	}
+	return output
 }
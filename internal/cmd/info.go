@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"path"
 	"strings"
 
 	"github.com/pkg-mngr/pkg/internal/manifest"
@@ -13,23 +14,54 @@ func Info(pkg string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	pkgManifest = pkgManifest.WithDirs(installDirs(pkgManifest))
 
 	output := fmt.Sprintf("\n\033[32;1m=== \033[0;1m%s: \033[0m%s\n", pkgManifest.Name, pkgManifest.Version)
 	output += fmt.Sprintln(pkgManifest.Description)
 	output += fmt.Sprintf("\033[34;4m%s\033[0m\n", pkgManifest.Homepage)
 	output += fmt.Sprintf("From: \033[34;4m%s\033[0m\n", pkgManifest.ManifestUrl)
 
+	// older versions are optional for manifest hosts to publish
+	if versions, err := manifest.Versions(pkgManifest.ManifestUrl); err == nil && len(versions) > 0 {
+		if len(versions) > 10 {
+			versions = append(versions[:10:10], fmt.Sprintf("and %d more", len(versions)-10))
+		}
+		output += fmt.Sprintf("Versions: %s\n", strings.Join(versions, ", "))
+	}
+
 	if len(pkgManifest.Dependencies) > 0 {
-		output += fmt.Sprintf("Dependencies: %s\n", strings.Join(pkgManifest.Dependencies, ", "))
+		dependencies := util.Map(pkgManifest.Dependencies, func(dep string, i int) string {
+			if constraints, ok := pkgManifest.Constraints[dep]; ok {
+				return fmt.Sprintf("%s %s", dep, constraints)
+			}
+			return dep
+		})
+		output += fmt.Sprintf("Dependencies: %s\n", strings.Join(dependencies, ", "))
 	}
 
 	if pkgManifest.Caveats != "" {
 		output += util.WrapText(fmt.Sprintf("Caveats: %s\n", pkgManifest.Caveats), 90)
 	}
 
-	output += "\nInstall:\n"
-	for _, line := range pkgManifest.Scripts.Install {
-		output += fmt.Sprintf("  %s\n", util.SyntaxHighlight(line))
+	if len(pkgManifest.Extract) > 0 {
+		output += "\nExtract:\n"
+		for _, step := range pkgManifest.Extract {
+			line := fmt.Sprintf("  %s to %s", path.Base(pkgManifest.Url), step.To)
+			if step.StripComponents > 0 {
+				line += fmt.Sprintf(", stripping %d components", step.StripComponents)
+			}
+			if len(step.Include) > 0 {
+				line += fmt.Sprintf(", including %s", strings.Join(step.Include, ", "))
+			}
+			output += line + "\n"
+		}
+	}
+
+	if len(pkgManifest.Scripts.Install) > 0 {
+		output += "\nInstall:\n"
+		for _, line := range pkgManifest.Scripts.Install {
+			output += fmt.Sprintf("  %s\n", util.SyntaxHighlight(line))
+		}
 	}
 	if len(pkgManifest.Scripts.Completions) > 0 {
 		output += "Completions:\n"
@@ -4,16 +4,37 @@ import (
 	"fmt"
 	"maps"
 	"slices"
+	"strings"
 
 	"github.com/pkg-mngr/pkg/internal/config"
 	"github.com/pkg-mngr/pkg/internal/util"
+	"github.com/pkg-mngr/pkg/internal/version"
 )
 
 func List(lockfile config.Lockfile) []string {
 	keys := slices.Collect(maps.Keys(lockfile))
 
 	output := util.Map(keys, func(key string, i int) string {
-		return fmt.Sprintf("\033[1m%s:\033[0m %s", key, lockfile[key].Version)
+		entry := lockfile[key]
+		line := fmt.Sprintf("\033[1m%s:\033[0m %s", key, entry.Version)
+		others := slices.DeleteFunc(slices.Clone(entry.Versions), func(v string) bool { return v == entry.Version })
+		if len(others) > 0 {
+			// whether switching to them would be an upgrade or a downgrade
+			others = util.Map(others, func(v string, _ int) string {
+				return fmt.Sprintf("%s %s", v, version.Diff(entry.Version, v).Arrow())
+			})
+			line += fmt.Sprintf(" (also %s)", strings.Join(others, ", "))
+		}
+		if entry.Reason == config.ReasonDependency {
+			line += " (dependency)"
+		}
+		if len(entry.Broken) > 0 {
+			line += fmt.Sprintf(" \033[31m(broken, missing %s)\033[0m", strings.Join(entry.Broken, ", "))
+		}
+		if entry.Pin != "" {
+			line += fmt.Sprintf(" (pinned to %s)", entry.Pin)
+		}
+		return line
 	})
 
 	slices.Sort(output)
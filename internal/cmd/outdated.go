@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"fmt"
+	"maps"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg-mngr/pkg/internal/config"
+	"github.com/pkg-mngr/pkg/internal/manifest"
+	"github.com/pkg-mngr/pkg/internal/util"
+	"github.com/pkg-mngr/pkg/internal/version"
+)
+
+// The versions available for an installed package
+type OutdatedPackage struct {
+	Name      string `json:"name"`
+	Installed string `json:"installed"`
+	// The latest version, empty if the manifest couldn't be fetched
+	Available string `json:"available,omitempty"`
+	// The newest version allowed by the package's pin, if it's pinned
+	Allowed string `json:"allowed,omitempty"`
+	Pin     string `json:"pin,omitempty"`
+	// Where the package's manifest comes from
+	Source string `json:"source"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Whether `pkg update` would update the package
+func (p OutdatedPackage) Outdated() bool {
+	target := p.Available
+	if p.Pin != "" {
+		target = p.Allowed
+	}
+	return target != "" && version.Compare(target, p.Installed) > 0
+}
+
+// Whether a newer version than the package's pin allows is available
+func (p OutdatedPackage) HeldBack() bool {
+	return p.Pin != "" && p.Available != p.Allowed && p.Available != "" && version.Compare(p.Available, p.Installed) > 0
+}
+
+// Whether the manifest host has rolled the package back to an older version
+// than the one installed, which `pkg update` only installs with
+// --allow-downgrade
+func (p OutdatedPackage) RolledBack() bool {
+	return p.Available != "" && version.Compare(p.Available, p.Installed) < 0
+}
+
+// Fetches the manifest of every installed package and returns the versions
+// available for them, sorted by name
+func Outdated(lockfile config.Lockfile) []OutdatedPackage {
+	pkgs := slices.Sorted(maps.Keys(lockfile))
+	return util.ParallelMap(pkgs, config.JOBS, func(pkg string, _ int) OutdatedPackage {
+		return checkOutdated(pkg, lockfile[pkg])
+	})
+}
+
+func checkOutdated(pkg string, entry config.LockfilePackage) OutdatedPackage {
+	result := OutdatedPackage{Name: pkg, Installed: entry.Version, Pin: entry.Pin, Source: manifestSource(entry.Manifest)}
+
+	latest, err := manifest.GetUrl(entry.Manifest)
+	if err != nil {
+		result.Error = strings.TrimSpace(err.Error())
+		return result
+	}
+	result.Available = latest.Version
+	if entry.Pin == "" {
+		return result
+	}
+
+	pin, err := version.ParseConstraints(entry.Pin)
+	if err != nil {
+		result.Error = strings.TrimSpace(err.Error())
+		return result
+	}
+	if pin.Check(latest.Version) {
+		result.Allowed = latest.Version
+		return result
+	}
+	// the host may not publish older versions, in which case nothing newer is
+	// allowed
+	if matching, err := manifest.GetMatching(entry.Manifest, pin); err == nil {
+		result.Allowed = matching.Version
+	}
+	return result
+}
+
+// Returns the host a manifest url is on, or the url itself for local
+// manifests
+func manifestSource(manifestUrl string) string {
+	if manifest.IsLocalFile(manifestUrl) {
+		return manifestUrl
+	}
+	if u, err := url.Parse(manifestUrl); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return manifestUrl
+}
+
+// Renders the packages with updates, that are held back by their pins, or that
+// have been rolled back, as the rows of a table
+func OutdatedTable(pkgs []OutdatedPackage) []string {
+	rows := [][]string{{"Package", "Installed", "Available", "Source", "Pin"}}
+	for _, pkg := range pkgs {
+		if !pkg.Outdated() && !pkg.HeldBack() && !pkg.RolledBack() {
+			continue
+		}
+		available := fmt.Sprintf("%s %s", pkg.Available, version.Diff(pkg.Installed, pkg.Available).Arrow())
+		pin := ""
+		if pkg.Pin != "" {
+			pin = pkg.Pin
+			if pkg.HeldBack() {
+				available = fmt.Sprintf("%s (%s allowed)", pkg.Available, pkg.Allowed)
+				if !pkg.Outdated() {
+					available = fmt.Sprintf("%s (held back)", pkg.Available)
+				}
+			}
+		}
+		rows = append(rows, []string{pkg.Name, pkg.Installed, available, pkg.Source, pin})
+	}
+	return renderTable(rows)
+}
+
+// Renders rows as aligned columns, with the first row as a bold header
+func renderTable(rows [][]string) []string {
+	widths := make([]int, len(rows[0]))
+	for _, row := range rows {
+		for i, cell := range row {
+			widths[i] = max(widths[i], displayWidth(cell))
+		}
+	}
+	lines := []string{}
+	for r, row := range rows {
+		line := ""
+		for i, cell := range row {
+			line += cell + strings.Repeat(" ", widths[i]-displayWidth(cell)+2)
+		}
+		line = strings.TrimRight(line, " ")
+		if r == 0 {
+			line = fmt.Sprintf("\033[1m%s\033[0m", line)
+		}
+		lines = append(lines, "  "+line)
+	}
+	return lines
+}
+
+var ansiPattern = regexp.MustCompile("\033\\[[0-9;]*m")
+
+// The number of characters a cell takes up on the terminal, leaving out colours
+func displayWidth(cell string) int {
+	return utf8.RuneCountInString(ansiPattern.ReplaceAllString(cell, ""))
+}
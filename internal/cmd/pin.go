@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/pkg-mngr/pkg/internal/config"
+	"github.com/pkg-mngr/pkg/internal/log"
+	"github.com/pkg-mngr/pkg/internal/version"
+)
+
+// Holds a package to the versions allowed by constraint during updates, or to
+// the installed version if constraint is empty
+func Pin(pkg, constraint string, lockfile config.Lockfile) error {
+	entry, ok := lockfile[pkg]
+	if !ok {
+		return ErrorPackageNotInstalled{Name: pkg}
+	}
+	if constraint == "" {
+		constraint = "= " + entry.Version
+	}
+	constraints, err := version.ParseConstraints(constraint)
+	if err != nil {
+		return err
+	}
+
+	entry.Pin = constraints.String()
+	lockfile[pkg] = entry
+	fmt.Printf("Pinned %s to %s\n", pkg, entry.Pin)
+	if !constraints.Check(entry.Version) {
+		log.Printf("The installed version %s does not satisfy the pin\n", entry.Version)
+	}
+	return nil
+}
+
+func Unpin(pkg string, lockfile config.Lockfile) error {
+	entry, ok := lockfile[pkg]
+	if !ok {
+		return ErrorPackageNotInstalled{Name: pkg}
+	}
+	if entry.Pin == "" {
+		log.Printf("%s is not pinned\n", pkg)
+		return nil
+	}
+
+	entry.Pin = ""
+	lockfile[pkg] = entry
+	fmt.Printf("Unpinned %s\n", pkg)
+	return nil
+}
@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/pkg-mngr/pkg/internal/cache"
+	"github.com/pkg-mngr/pkg/internal/config"
+	"github.com/pkg-mngr/pkg/internal/manifest"
+	"github.com/pkg-mngr/pkg/internal/util"
+)
+
+// Downloads everything the plans need that isn't cached yet into the cache,
+// config.JOBS at a time, so that installing the plans one package at a time
+// only has to take their downloads from the cache. Returns the error for each
+// download that failed, by checksum, or ErrorInterrupted if interrupted.
+func prefetch(plans ...plan) (map[string]error, error) {
+	// packages with the same download only download it once
+	downloads := []manifest.Manifest{}
+	for _, p := range plans {
+		for _, node := range p {
+			sha := strings.ToLower(node.Manifest.Sha256)
+			if cache.Has(sha) || slices.ContainsFunc(downloads, func(m manifest.Manifest) bool { return strings.ToLower(m.Sha256) == sha }) {
+				continue
+			}
+			downloads = append(downloads, node.Manifest)
+		}
+	}
+	// offline, the plans can only be installed if everything is cached already
+	if len(downloads) == 0 || config.OFFLINE {
+		return nil, nil
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Println("\033[32;1m===\033[0;1m Downloading\033[0m")
+	progress := util.NewProgress(util.Map(downloads, func(m manifest.Manifest, _ int) string {
+		return fmt.Sprintf("%s %s", m.Name, m.Version)
+	}))
+	errs := util.ParallelMap(downloads, config.JOBS, func(m manifest.Manifest, i int) error {
+		progress.Update(i, "Downloading...")
+		err := fetchToCache(ctx, m, func(status string) { progress.Update(i, status) })
+		if err != nil {
+			progress.Finish(i, "\033[31mFailed\033[0m")
+		} else {
+			progress.Finish(i, "\033[32mDone\033[0m")
+		}
+		return err
+	})
+	fmt.Println()
+	if ctx.Err() != nil {
+		return nil, ErrorInterrupted{}
+	}
+
+	failed := map[string]error{}
+	for i, err := range errs {
+		if err != nil {
+			failed[strings.ToLower(downloads[i].Sha256)] = err
+		}
+	}
+	return failed, nil
+}
+
+// Downloads a package's file into a temporary directory and verifies it, then
+// adds it to the cache
+func fetchToCache(ctx context.Context, pkgManifest manifest.Manifest, report func(status string)) error {
+	if err := os.MkdirAll(config.PKG_TMP, 0o755); err != nil {
+		return fmt.Errorf("Error creating %s: %v\n", config.PKG_TMP, err)
+	}
+	dir, err := os.MkdirTemp(config.PKG_TMP, "download-")
+	if err != nil {
+		return fmt.Errorf("Error creating download directory: %v\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, path.Base(pkgManifest.Url))
+	checksum, err := util.FetchWithProgress(ctx, pkgManifest.Url, filename, pkgManifest.Name, report)
+	if err != nil {
+		return err
+	}
+	if err := util.CompareChecksum(filename, pkgManifest.Sha256, checksum, pkgManifest.Name); err != nil {
+		return err
+	}
+	return cache.Put(pkgManifest.Sha256, filename)
+}
+
+// Returns the errors downloading anything in the plan failed with, if any did
+func (p plan) prefetchErr(failed map[string]error) error {
+	errs := []error{}
+	for _, node := range p {
+		if err, ok := failed[strings.ToLower(node.Manifest.Sha256)]; ok {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
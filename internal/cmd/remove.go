@@ -2,48 +2,323 @@ package cmd
 
 import (
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
 	"slices"
+	"strings"
 
 	"github.com/pkg-mngr/pkg/internal/config"
+	"github.com/pkg-mngr/pkg/internal/log"
+	"github.com/pkg-mngr/pkg/internal/manifest"
+	"github.com/pkg-mngr/pkg/internal/util"
 )
 
-func Remove(pkg string, lockfile config.Lockfile, isForUpdate bool) error {
-	if _, ok := lockfile[pkg]; !ok {
-		return ErrorPackageNotInstalled{Name: pkg}
+// Removes packages, along with the dependencies that were only installed for
+// them, or one of several installed versions of a package with name@version.
+// A package that others depend on is only removed if they're being removed
+// too, or with cascade, which removes everything that depends on it, or
+// force, which leaves the packages that depend on it marked as broken. With
+// dryRun, prints the files that would be deleted instead, recording the
+// removal only in the in-memory lockfile.
+func Remove(pkgs []string, cascade, force, skipConfirmation, dryRun bool, lockfile config.Lockfile) error {
+	names := []string{}
+	for _, pkg := range pkgs {
+		name, _ := manifest.SplitVersion(pkg)
+		if _, ok := lockfile[name]; !ok {
+			return ErrorPackageNotInstalled{Name: name}
+		}
 	}
-	if !isForUpdate {
-		for installed := range lockfile {
-			if slices.Contains(lockfile[installed].Dependencies, pkg) {
-				return ErrorPackageDependencyOf{Name: pkg, Dependent: installed}
+	for _, pkg := range pkgs {
+		name, ver := manifest.SplitVersion(pkg)
+		if ver != "" {
+			if err := removeVersion(name, ver, dryRun, lockfile); err != nil {
+				return err
 			}
+			continue
+		}
+		if !slices.Contains(names, name) {
+			names = append(names, name)
 		}
 	}
+	if len(names) == 0 {
+		return nil
+	}
+	before := lockfile.Clone()
 
-	fmt.Printf("Removing %s...\n", pkg)
-	if err := removeFiles(lockfile[pkg].Files); err != nil {
-		return err
+	removing := slices.Clone(names)
+	for _, pkg := range names {
+		// packages being removed together don't hold each other back
+		all := slices.DeleteFunc(allDependents(pkg, lockfile), func(dependent string) bool { return slices.Contains(names, dependent) })
+		if len(all) == 0 {
+			continue
+		}
+		switch {
+		case cascade:
+			fmt.Printf("Removing %s will also remove the packages that depend on it: %s\n", pkg, strings.Join(all, ", "))
+			if !skipConfirmation && !dryRun && !util.Confirm("Proceed?") {
+				return ErrorRemoveCancelled{}
+			}
+			for _, dependent := range all {
+				if !slices.Contains(removing, dependent) {
+					removing = append(removing, dependent)
+				}
+			}
+		case force:
+			direct := slices.DeleteFunc(dependents(pkg, lockfile), func(dependent string) bool { return slices.Contains(names, dependent) })
+			log.Printf("Removing %s anyway, which breaks %s\n", pkg, strings.Join(direct, ", "))
+			for _, dependent := range direct {
+				entry := lockfile[dependent]
+				entry.Broken = append(slices.Clone(entry.Broken), pkg)
+				lockfile[dependent] = entry
+			}
+		default:
+			return ErrorPackageDependencyOf{Name: pkg, Dependents: all}
+		}
 	}
 
-	for _, dep := range lockfile[pkg].Dependencies {
-		if err := Remove(dep, lockfile, isForUpdate); err != nil {
+	// dependencies that were only installed for these packages aren't needed
+	// any more once they're gone
+	deps := []string{}
+	for _, removed := range removing {
+		deps = append(deps, dependencyClosure(removed, lockfile)...)
+	}
+	for _, removed := range removalOrder(removing, lockfile) {
+		if err := removePackage(removed, dryRun, lockfile); err != nil {
 			return err
 		}
 	}
+	for _, orphan := range orphans(lockfile) {
+		if !slices.Contains(deps, orphan) {
+			continue
+		}
+		if err := removePackage(orphan, dryRun, lockfile); err != nil {
+			return err
+		}
+	}
+	if dryRun {
+		fmt.Println()
+		printLockfileDiff(before, lockfile)
+	}
+	return nil
+}
 
-	lockfile.Remove(pkg)
+// Orders packages so that each comes before the packages it depends on, so
+// that nothing left installed part way through depends on a package that's
+// already gone
+func removalOrder(pkgs []string, lockfile config.Lockfile) []string {
+	ordered := []string{}
+	remaining := slices.Clone(pkgs)
+	slices.Sort(remaining)
+	for len(remaining) > 0 {
+		i := slices.IndexFunc(remaining, func(pkg string) bool {
+			return !slices.ContainsFunc(dependents(pkg, lockfile), func(dependent string) bool { return slices.Contains(remaining, dependent) })
+		})
+		// packages that depend on each other can go in any order
+		if i == -1 {
+			i = 0
+		}
+		ordered = append(ordered, remaining[i])
+		remaining = slices.Delete(remaining, i, i+1)
+	}
+	return ordered
+}
+
+// Returns every installed package that depends on pkg, directly or
+// indirectly
+func allDependents(pkg string, lockfile config.Lockfile) []string {
+	all := []string{}
+	queue := dependents(pkg, lockfile)
+	for len(queue) > 0 {
+		dependent := queue[0]
+		queue = queue[1:]
+		if dependent == pkg || slices.Contains(all, dependent) {
+			continue
+		}
+		all = append(all, dependent)
+		queue = append(queue, dependents(dependent, lockfile)...)
+	}
+	slices.Sort(all)
+	return all
+}
+
+// Removes packages that were installed as dependencies, but aren't needed by
+// any explicitly installed package any more. Returns the removed packages.
+func Autoremove(lockfile config.Lockfile) ([]string, error) {
+	removed := orphans(lockfile)
+	for _, pkg := range removed {
+		if err := removePackage(pkg, false, lockfile); err != nil {
+			return nil, err
+		}
+	}
+	return removed, nil
+}
+
+// Marks packages as installed explicitly or as a dependency
+func Mark(pkgs []string, reason string, lockfile config.Lockfile) error {
+	for _, pkg := range pkgs {
+		entry, ok := lockfile[pkg]
+		if !ok {
+			return ErrorPackageNotInstalled{Name: pkg}
+		}
+		entry.Reason = reason
+		lockfile[pkg] = entry
+		if reason == config.ReasonDependency {
+			fmt.Printf("Marked %s as installed as a dependency\n", pkg)
+		} else {
+			fmt.Printf("Marked %s as installed explicitly\n", pkg)
+		}
+	}
+
+	if reason == config.ReasonDependency {
+		for _, orphan := range orphans(lockfile) {
+			if slices.Contains(pkgs, orphan) {
+				log.Printf("No explicitly installed package needs %s, so `pkg autoremove` will remove it\n", orphan)
+			}
+		}
+	}
 	return nil
 }
 
-func removeFiles(files []string) error {
-	for _, file := range files {
-		fmt.Printf("Deleting %s...\n", file)
-		pkgHome := config.PKG_HOME
-		if err := os.RemoveAll(filepath.Join(pkgHome, file)); err != nil {
-			return fmt.Errorf("Error removing file %s: %v\n", filepath.Join(pkgHome, file), err)
+// Removes a package in its own transaction, so that the lockfile is written as
+// soon as it's gone and a failure part way through leaves it installed
+func removePackage(pkg string, dryRun bool, lockfile config.Lockfile) error {
+	fmt.Printf("Removing %s...\n", pkg)
+	if dryRun {
+		removeFiles(config.Roots(lockfile[pkg].Files))
+		overwritten := lockfile[pkg].Overwritten
+		lockfile.Remove(pkg)
+		return restoreOverwritten(nil, overwritten, lockfile)
+	}
+
+	return withTransaction(lockfile, func(tx *transaction) error {
+		if err := tx.remove(config.Roots(lockfile[pkg].Files)); err != nil {
+			return err
+		}
+		overwritten := lockfile[pkg].Overwritten
+		lockfile.Remove(pkg)
+		return restoreOverwritten(tx, overwritten, lockfile)
+	})
+}
+
+// Returns the packages installed as dependencies that no explicitly installed
+// package depends on, directly or indirectly
+func orphans(lockfile config.Lockfile) []string {
+	needed := []string{}
+	for pkg, entry := range lockfile {
+		if entry.Reason != config.ReasonDependency {
+			needed = append(needed, dependencyClosure(pkg, lockfile)...)
 		}
 	}
 
+	orphans := []string{}
+	for pkg, entry := range lockfile {
+		if entry.Reason == config.ReasonDependency && !slices.Contains(needed, pkg) {
+			orphans = append(orphans, pkg)
+		}
+	}
+	slices.Sort(orphans)
+	return orphans
+}
+
+// Returns every installed package that pkg depends on, directly or
+// indirectly
+func dependencyClosure(pkg string, lockfile config.Lockfile) []string {
+	deps := []string{}
+	queue := slices.Clone(lockfile[pkg].Dependencies)
+	for len(queue) > 0 {
+		dep := queue[0]
+		queue = queue[1:]
+		if slices.Contains(deps, dep) {
+			continue
+		}
+		deps = append(deps, dep)
+		queue = append(queue, lockfile[dep].Dependencies...)
+	}
+	return deps
+}
+
+// Gives files that a removed package took over with --overwrite back to the
+// packages they belonged to, where possible. Without a transaction, only
+// prints what would be restored, for dry runs.
+func restoreOverwritten(tx *transaction, overwritten map[string]string, lockfile config.Lockfile) error {
+	for _, file := range slices.Sorted(maps.Keys(overwritten)) {
+		owner := overwritten[file]
+		entry, ok := lockfile[owner]
+		if !ok {
+			continue
+		}
+
+		// links into the owner's active version can be recreated
+		target := filepath.Join(config.PKG_OPT, owner, "current", file)
+		if _, err := os.Lstat(target); len(entry.Versions) == 0 || !isLinked(file) || err != nil {
+			log.Printf("%s belonged to %s before it was overwritten, reinstall %s to restore it\n", file, owner, owner)
+			continue
+		}
+		record := config.File{Path: file, Type: config.FileTypeSymlink, Target: target}
+		if tx == nil {
+			fmt.Printf("Would restore %s for %s\n", file, owner)
+		} else {
+			fmt.Printf("Restoring %s for %s...\n", file, owner)
+			if err := tx.link(filepath.Join(config.PKG_HOME, file), target); err != nil {
+				return err
+			}
+			var err error
+			if record, err = config.Stat(file); err != nil {
+				return err
+			}
+		}
+		entry.Files = append(slices.Clone(entry.Files), record)
+		config.SortFiles(entry.Files)
+		entry.Links = maps.Clone(entry.Links)
+		if entry.Links == nil {
+			entry.Links = map[string]string{}
+		}
+		entry.Links[file] = target
+		lockfile[owner] = entry
+	}
 	return nil
 }
+
+// Removes one of several versions installed side by side, leaving the package
+// installed
+func removeVersion(pkg, ver string, dryRun bool, lockfile config.Lockfile) error {
+	entry := lockfile[pkg]
+	if !slices.Contains(entry.Versions, ver) {
+		return ErrorVersionNotInstalled{Name: pkg, Version: ver, Installed: entry.Versions}
+	}
+	if entry.Version == ver {
+		return ErrorVersionActive{Name: pkg, Version: ver}
+	}
+
+	before := lockfile.Clone()
+	fmt.Printf("Removing %s %s...\n", pkg, ver)
+	versionDir := filepath.Join("opt", pkg, ver)
+	forget := func() {
+		entry.Versions = slices.DeleteFunc(slices.Clone(entry.Versions), func(v string) bool { return v == ver })
+		entry.Files = slices.DeleteFunc(slices.Clone(entry.Files), func(file config.File) bool { return isWithin(file.Path, versionDir) })
+		lockfile[pkg] = entry
+	}
+	if dryRun {
+		removeFiles([]string{versionDir})
+		forget()
+		fmt.Println()
+		printLockfileDiff(before, lockfile)
+		return nil
+	}
+
+	return withTransaction(lockfile, func(tx *transaction) error {
+		if err := tx.remove([]string{versionDir}); err != nil {
+			return err
+		}
+		forget()
+		return nil
+	})
+}
+
+// Prints the files a dry run would delete
+func removeFiles(files []string) {
+	for _, file := range files {
+		fmt.Printf("Would delete %s\n", file)
+	}
+}
@@ -0,0 +1,356 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/pkg-mngr/pkg/internal/cache"
+	"github.com/pkg-mngr/pkg/internal/config"
+	"github.com/pkg-mngr/pkg/internal/manifest"
+	"github.com/pkg-mngr/pkg/internal/util"
+	"github.com/pkg-mngr/pkg/internal/version"
+)
+
+// The packages that need to be installed to satisfy a request, in the order
+// they need to be installed, so that dependencies come before their dependents
+type plan []planNode
+
+type planNode struct {
+	Manifest manifest.Manifest
+	// The package that caused this one to be installed, or empty if it was
+	// requested directly
+	Dependent string
+	// The dependencies to record for this package in the lockfile
+	Dependencies []string
+	// The existing lockfile entry if this package is being updated
+	Previous *config.LockfilePackage
+	// Whether the previous version stays installed alongside this one instead
+	// of being replaced
+	KeepPrevious bool
+}
+
+// Fetches the manifests of every dependency of roots that isn't installed yet,
+// and orders them all for installation. Installed dependencies that are too
+// old for a package's version constraints are offered to be upgraded. Errors
+// for every dependency that can't be installed are returned together, as are
+// dependency cycles.
+func resolve(roots []manifest.Manifest, lockfile config.Lockfile, skipConfirmation bool) (plan, error) {
+	manifests := map[string]manifest.Manifest{}
+	// the package that caused each dependency to be installed
+	dependents := map[string]string{}
+	// the package that caused each installed dependency to be upgraded
+	upgradedFor := map[string]string{}
+	queue := []string{}
+	for _, root := range roots {
+		manifests[root.Name] = root
+		queue = append(queue, root.Name)
+	}
+
+	// fetch the whole dependency graph before installing anything, a level at a
+	// time, fetching the manifests of each level at once
+	errs := []error{}
+	failed := map[string]bool{}
+	for len(queue) > 0 {
+		fetches := []manifestFetch{}
+		next := []string{}
+		for _, name := range queue {
+			pkgManifest := manifests[name]
+			for _, dep := range pkgManifest.Dependencies {
+				if _, ok := manifests[dep]; ok || failed[dep] {
+					continue
+				}
+				if slices.ContainsFunc(fetches, func(fetch manifestFetch) bool { return fetch.Name == dep }) {
+					continue
+				}
+
+				if installed, ok := lockfile[dep]; ok {
+					constraints := pkgManifest.Constraints[dep]
+					if constraints.Check(installed.Version) {
+						continue
+					}
+					upgrade, err := offerUpgrade(dep, installed, name, constraints, skipConfirmation)
+					if errConstraint := (ErrorDependencyConstraint{}); errors.As(err, &errConstraint) {
+						// reported below along with every other requirement on it
+						continue
+					}
+					if err != nil {
+						errs = append(errs, err)
+						failed[dep] = true
+						continue
+					}
+					manifests[dep] = upgrade
+					upgradedFor[dep] = name
+					next = append(next, dep)
+					continue
+				}
+
+				fetches = append(fetches, manifestFetch{Name: dep, Dependent: name, Constraints: pkgManifest.Constraints[dep]})
+			}
+		}
+
+		fetched := util.ParallelMap(fetches, config.JOBS, func(fetch manifestFetch, _ int) manifestFetch {
+			fetch.Manifest, fetch.Err = fetchDependency(fetch.Name, fetch.Constraints)
+			return fetch
+		})
+		for _, fetch := range fetched {
+			if fetch.Err != nil {
+				errs = append(errs, ErrorDependency{Name: fetch.Name, Dependent: fetch.Dependent, Err: fetch.Err})
+				failed[fetch.Name] = true
+				continue
+			}
+			manifests[fetch.Name] = fetch.Manifest
+			dependents[fetch.Name] = fetch.Dependent
+			next = append(next, fetch.Name)
+		}
+		queue = next
+	}
+
+	// check every version constraint against the version each package will be
+	// at once the plan is installed, including the constraints of installed
+	// packages that aren't being replaced
+	requirements := map[string][]Requirement{}
+	for name, pkgManifest := range manifests {
+		for dep, constraints := range pkgManifest.Constraints {
+			requirements[dep] = append(requirements[dep], Requirement{Dependent: name, Constraints: constraints})
+		}
+	}
+	for name, entry := range lockfile {
+		// pinned packages can't be moved outside their pin, even when requested
+		// directly
+		if pin, err := version.ParseConstraints(entry.Pin); entry.Pin != "" && err == nil {
+			requirements[name] = append(requirements[name], Requirement{Dependent: name, Constraints: pin, Pinned: true})
+		}
+		if _, ok := manifests[name]; ok {
+			continue
+		}
+		for dep, raw := range entry.Constraints {
+			constraints, err := version.ParseConstraints(raw)
+			if err != nil {
+				continue
+			}
+			requirements[dep] = append(requirements[dep], Requirement{Dependent: name, Constraints: constraints})
+		}
+	}
+	for _, dep := range slices.Sorted(maps.Keys(requirements)) {
+		depVersion := ""
+		if depManifest, ok := manifests[dep]; ok {
+			depVersion = depManifest.Version
+		} else if entry, ok := lockfile[dep]; ok {
+			depVersion = entry.Version
+		}
+		if depVersion == "" || failed[dep] {
+			continue
+		}
+
+		reqs := requirements[dep]
+		if !slices.ContainsFunc(reqs, func(req Requirement) bool { return !req.Constraints.Check(depVersion) }) {
+			continue
+		}
+		slices.SortFunc(reqs, func(a, b Requirement) int { return strings.Compare(a.Dependent, b.Dependent) })
+		errs = append(errs, ErrorDependencyConstraint{Name: dep, Version: depVersion, Requirements: reqs})
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	// order packages so that dependencies are installed first, using a depth
+	// first search that also catches cycles
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[string]int{}
+	order := plan{}
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visiting:
+			cycleStart := slices.Index(path, name)
+			return ErrorDependencyCycle{Cycle: append(slices.Clone(path[cycleStart:]), name)}
+		case visited:
+			return nil
+		}
+
+		state[name] = visiting
+		path = append(path, name)
+		pkgManifest := manifests[name]
+		for _, dep := range pkgManifest.Dependencies {
+			if _, ok := manifests[dep]; !ok {
+				continue
+			}
+			if err := visit(dep, path); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+
+		node := planNode{Manifest: pkgManifest, Dependent: dependents[name]}
+		if upgradedFor[name] != "" {
+			node.Dependent = upgradedFor[name]
+		}
+		if previous, ok := lockfile[name]; ok {
+			node.Previous = &previous
+		}
+		// every dependency is recorded, whether or not it was installed for this
+		// package, so that dependencies can't be removed while anything needs them
+		node.Dependencies = slices.Clone(pkgManifest.Dependencies)
+		order = append(order, node)
+		return nil
+	}
+	for _, root := range roots {
+		if err := visit(root.Name, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+}
+
+// A package whose manifest is being fetched, and the result
+type manifestFetch struct {
+	Name string
+	// The package it's a dependency of, if it is one
+	Dependent string
+	// The dependent's constraints on it
+	Constraints version.Constraints
+	Manifest    manifest.Manifest
+	Err         error
+}
+
+// Fetches the manifest of a dependency, falling back to an older version if
+// the latest isn't allowed by constraints and the manifest host publishes one
+// that is. Otherwise the constraints are reported once the whole graph has
+// been fetched.
+func fetchDependency(dep string, constraints version.Constraints) (manifest.Manifest, error) {
+	depManifest, err := manifest.Get(dep)
+	if err != nil {
+		return manifest.Manifest{}, err
+	}
+	if !constraints.Check(depManifest.Version) {
+		if matching, err := manifest.GetMatching(depManifest.ManifestUrl, constraints); err == nil {
+			depManifest = matching
+		}
+	}
+	return depManifest, nil
+}
+
+// Offers to upgrade an installed package that's too old for the version
+// constraints of a package being installed
+func offerUpgrade(name string, installed config.LockfilePackage, dependent string, constraints version.Constraints, skipConfirmation bool) (manifest.Manifest, error) {
+	errConstraint := ErrorDependencyConstraint{
+		Name:         name,
+		Version:      installed.Version,
+		Requirements: []Requirement{{Dependent: dependent, Constraints: constraints}},
+	}
+
+	// the upgrade has to stay within the package's pin too
+	allowed := constraints
+	if pin, err := version.ParseConstraints(installed.Pin); installed.Pin != "" && err == nil {
+		allowed = append(slices.Clone(constraints), pin...)
+	}
+
+	latest, err := manifest.GetUrl(installed.Manifest)
+	if err != nil {
+		return manifest.Manifest{}, ErrorDependency{Name: name, Dependent: dependent, Err: err}
+	}
+	if !allowed.Check(latest.Version) {
+		if matching, err := manifest.GetMatching(installed.Manifest, allowed); err == nil {
+			latest = matching
+		}
+	}
+	if version.Compare(latest.Version, installed.Version) <= 0 || !allowed.Check(latest.Version) {
+		return manifest.Manifest{}, errConstraint
+	}
+
+	question := fmt.Sprintf("%s requires %s %s, but %s is installed. Upgrade to %s?",
+		dependent, name, constraints, installed.Version, latest.Version)
+	if !skipConfirmation && !util.Confirm(question) {
+		return manifest.Manifest{}, errConstraint
+	}
+	return latest, nil
+}
+
+func (p plan) print() {
+	fmt.Println("\n\033[32;1m===\033[0;1m Installation plan\033[0m")
+	for i, node := range p {
+		line := fmt.Sprintf("  %d. \033[1m%s:\033[0m %s", i+1, node.Manifest.Name, node.Manifest.Version)
+		if node.Previous != nil && node.KeepPrevious {
+			line += fmt.Sprintf(" (alongside %s)", node.Previous.Version)
+		} else if node.Previous != nil {
+			direction := version.Diff(node.Previous.Version, node.Manifest.Version)
+			line += fmt.Sprintf(" %s (%s from %s)", direction.Arrow(), direction, node.Previous.Version)
+		}
+		if node.Dependent != "" {
+			line += fmt.Sprintf(" (dependency of %s)", node.Dependent)
+		}
+		fmt.Println(line)
+	}
+	fmt.Println()
+}
+
+// Brings a plan that was resolved before other plans were installed up to
+// date with the lockfile, leaving out packages that are now installed at the
+// planned version
+func (p plan) refresh(lockfile config.Lockfile) plan {
+	refreshed := plan{}
+	for _, node := range p {
+		entry, ok := lockfile[node.Manifest.Name]
+		if ok && entry.Version == node.Manifest.Version {
+			continue
+		}
+		node.Previous = nil
+		if ok {
+			node.Previous = &entry
+		}
+		refreshed = append(refreshed, node)
+	}
+	return refreshed
+}
+
+// Returns ErrorOffline listing every download that isn't cached, if offline
+func (p plan) checkOffline() error {
+	if !config.OFFLINE {
+		return nil
+	}
+	missing := []string{}
+	for _, node := range p {
+		if !cache.Has(node.Manifest.Sha256) {
+			missing = append(missing, fmt.Sprintf("%s %s: %s", node.Manifest.Name, node.Manifest.Version, node.Manifest.Url))
+		}
+	}
+	if len(missing) > 0 {
+		return cache.ErrorOffline{Missing: missing}
+	}
+	return nil
+}
+
+// Downloads and installs every package in the plan in order. Stops at the
+// first failure, leaving the transaction to be rolled back.
+func (p plan) install(tx *transaction, skipConfirmation bool) error {
+	for _, node := range p {
+		if node.Previous != nil {
+			fmt.Printf("Updating %s...\n", node.Manifest.Name)
+		} else {
+			fmt.Printf("Installing %s...\n", node.Manifest.Name)
+		}
+
+		if err := download(tx, &node.Manifest); err != nil {
+			return err
+		}
+		if err := install(tx, node, skipConfirmation); err != nil {
+			return fmt.Errorf("%s: %w", node.Manifest.Name, err)
+		}
+
+		if node.Previous != nil {
+			fmt.Printf("Finished updating %s\n", node.Manifest.Name)
+		} else {
+			fmt.Printf("Finished installing %s\n", node.Manifest.Name)
+		}
+	}
+	return nil
+}
@@ -2,32 +2,54 @@ package cmd
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net/http"
 	"slices"
 	"strings"
 
+	"github.com/pkg-mngr/pkg/internal/cache"
 	"github.com/pkg-mngr/pkg/internal/config"
+	"github.com/pkg-mngr/pkg/internal/manifest"
+	"github.com/pkg-mngr/pkg/internal/version"
 )
 
 func Search(query string) ([]string, error) {
-	resp, err := http.Get(config.MANIFEST_HOST + "/index.json")
-	if err != nil || resp.StatusCode != http.StatusOK {
+	data, err := manifest.FetchRemote(config.MANIFEST_HOST + "/index.json")
+	if errOffline := (cache.ErrorOffline{}); errors.As(err, &errOffline) {
+		return nil, err
+	}
+	if err != nil {
 		return nil, fmt.Errorf("%s/index.json not found", config.MANIFEST_HOST)
 	}
-	defer resp.Body.Close()
 
-	var index map[string]struct{ Version, Description string }
-	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+	var index map[string]struct {
+		Version, Description string
+		Versions             []string
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
 		return nil, fmt.Errorf(
-			"Error decoding %s/index.json, expected format {name: {version: string, description: string}}.",
+			"Error decoding %s/index.json, expected format {name: {version: string, description: string, versions?: string[]}}.",
 			config.MANIFEST_HOST)
 	}
 
+	// `name@version` searches for versions of a package starting with version
+	query, versionQuery, searchVersions := strings.Cut(query, "@")
+
 	packages := make([]string, 0, len(index))
 	for name, data := range index {
 		line := fmt.Sprintf("\033[1m%s:\033[0m %s - %s", name, data.Version, data.Description)
 		searchLine := strings.ToLower(fmt.Sprintf("%s %s", name, data.Description))
+		if searchVersions {
+			versions := slices.DeleteFunc(slices.Clone(data.Versions), func(v string) bool {
+				return !strings.HasPrefix(v, versionQuery)
+			})
+			if len(versions) == 0 {
+				continue
+			}
+			slices.SortFunc(versions, func(a, b string) int { return version.Compare(b, a) })
+			line = fmt.Sprintf("\033[1m%s:\033[0m %s - %s", name, strings.Join(versions, ", "), data.Description)
+			searchLine = strings.ToLower(name)
+		}
 		if strings.Contains(searchLine, strings.ToLower(query)) {
 			packages = append(packages, line)
 		}
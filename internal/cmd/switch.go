@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/pkg-mngr/pkg/internal/config"
+	"github.com/pkg-mngr/pkg/internal/log"
+)
+
+// Makes an installed version of a package the active one
+func Switch(pkg, ver string, lockfile config.Lockfile) error {
+	entry, ok := lockfile[pkg]
+	if !ok {
+		return ErrorPackageNotInstalled{Name: pkg}
+	}
+	if !slices.Contains(entry.Versions, ver) {
+		installed := entry.Versions
+		if len(installed) == 0 {
+			installed = []string{entry.Version}
+		}
+		return ErrorVersionNotInstalled{Name: pkg, Version: ver, Installed: installed}
+	}
+	if entry.Version == ver {
+		log.Printf("%s %s is already active\n", pkg, ver)
+		return nil
+	}
+
+	fmt.Printf("Switching %s from %s to %s...\n", pkg, entry.Version, ver)
+	return withTransaction(lockfile, func(tx *transaction) error {
+		return tx.switchTo(pkg, ver)
+	})
+}
+
+// Activates an installed version of a package and records the change in the
+// lockfile
+func (tx *transaction) switchTo(pkg, ver string) error {
+	entry := tx.lockfile[pkg]
+	// check for conflicts before changing anything
+	wanted, err := linkedFiles(versionPrefix(pkg, ver))
+	if err != nil {
+		return err
+	}
+	if _, err := tx.claim(pkg, wanted); err != nil {
+		return err
+	}
+	files, links, err := tx.activate(pkg, ver, config.Roots(entry.Files))
+	if err != nil {
+		return err
+	}
+	records, err := recordFiles(pkg, files, entry.Files, "")
+	if err != nil {
+		return err
+	}
+	entry.Version = ver
+	entry.Files = records
+	entry.Links = links
+	tx.lockfile[pkg] = entry
+	return nil
+}
@@ -0,0 +1,418 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg-mngr/pkg/internal/config"
+	"github.com/pkg-mngr/pkg/internal/log"
+	"github.com/pkg-mngr/pkg/internal/manifest"
+)
+
+// A transaction records every change made to PKG_HOME while installing
+// packages, so that they can all be undone if anything fails
+type transaction struct {
+	ctx      context.Context
+	stop     context.CancelFunc
+	dir      string
+	lockfile config.Lockfile
+	journal  *config.Journal
+	// Whether files owned by other packages may be taken over
+	overwrite bool
+}
+
+func beginTransaction(lockfile config.Lockfile) (*transaction, error) {
+	if err := os.MkdirAll(config.PKG_TMP, 0o755); err != nil {
+		return nil, fmt.Errorf("Error creating %s: %v\n", config.PKG_TMP, err)
+	}
+	dir, err := os.MkdirTemp(config.PKG_TMP, "txn-")
+	if err != nil {
+		return nil, fmt.Errorf("Error creating transaction directory: %v\n", err)
+	}
+
+	journal := &config.Journal{Dir: dir, Snapshot: lockfile.Clone()}
+	if err := journal.Begin(); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	// catch interrupts so that we get the chance to roll back instead of exiting
+	// with a half-installed package
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
+	return &transaction{
+		ctx:      ctx,
+		stop:     stop,
+		dir:      dir,
+		lockfile: lockfile,
+		journal:  journal,
+	}, nil
+}
+
+// Returns an error if the transaction was interrupted
+func (tx *transaction) check() error {
+	if tx.ctx.Err() != nil {
+		return ErrorInterrupted{}
+	}
+	return nil
+}
+
+// Returns ErrorInterrupted if the transaction was interrupted, since err is
+// then most likely caused by the interruption, otherwise returns err
+func (tx *transaction) interruptedOr(err error) error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	return err
+}
+
+// Creates the working directory for a package, and returns the directories its
+// manifest should be templated with. These are the ones it's installed into,
+// since binaries can have them compiled in.
+func (tx *transaction) stage(name, ver string) (manifest.Dirs, error) {
+	if ver == "" || ver == "." || ver == ".." || strings.ContainsAny(ver, `/\`) {
+		return manifest.Dirs{}, fmt.Errorf("Invalid version %q for %s\n", ver, name)
+	}
+	workDir := tx.workDir(name)
+	if err := os.MkdirAll(workDir, 0o755); err != nil {
+		return manifest.Dirs{}, fmt.Errorf("Error creating %s: %v\n", workDir, err)
+	}
+	return manifest.DirsIn(versionPrefix(name, ver), workDir), nil
+}
+
+func (tx *transaction) workDir(name string) string {
+	return filepath.Join(tx.dir, name, "work")
+}
+
+// Moves a file in PKG_HOME out of the way, so that it can be restored if the
+// transaction is rolled back
+func (tx *transaction) backup(file string) error {
+	from := filepath.Join(config.PKG_HOME, file)
+	if _, err := os.Lstat(from); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Error reading %s: %v\n", from, err)
+	}
+
+	// the same file may be backed up more than once in a transaction
+	to := filepath.Join(tx.dir, "backup", strconv.Itoa(len(tx.journal.Moves)), file)
+	return tx.move(from, to)
+}
+
+// Deletes files in PKG_HOME. They're only moved out of the way until the
+// transaction is committed, so that rolling back can restore them.
+func (tx *transaction) remove(files []string) error {
+	for _, file := range files {
+		if err := tx.check(); err != nil {
+			return err
+		}
+		fmt.Printf("Deleting %s...\n", file)
+		if err := tx.backup(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The directories of an installed version whose contents are linked into
+// PKG_HOME, as patterns
+var linkedDirs = []string{"bin", "share/man/*", "share/zsh/site-functions"}
+
+// The prefix a version of a package is installed into
+func versionPrefix(name, ver string) string {
+	return filepath.Join(config.PKG_OPT, name, ver)
+}
+
+// Puts an empty prefix for a version of a package in place in PKG_OPT for it
+// to be installed into, replacing that version if it's already installed. It's
+// moved in through the journal, so rolling back moves it out again along with
+// everything installed into it.
+func (tx *transaction) place(name, ver string) error {
+	root := filepath.Join(tx.dir, name, "prefix")
+	for _, dir := range []string{"bin", "opt", "share/zsh/site-functions"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			return fmt.Errorf("Error creating %s: %v\n", filepath.Join(root, dir), err)
+		}
+	}
+	if err := tx.backup(filepath.Join("opt", name, ver)); err != nil {
+		return err
+	}
+	return tx.move(root, versionPrefix(name, ver))
+}
+
+// Makes an installed version of a package the active one, by pointing
+// opt/<name>/current at it and linking its binaries, man pages and completions
+// into PKG_HOME through that link. Links of the previously active version that
+// the new one doesn't have are removed. The version's files must have been
+// claimed already. Returns the files in PKG_HOME the package now owns, and the
+// links among them with their targets.
+func (tx *transaction) activate(name, ver string, previousFiles []string) ([]string, map[string]string, error) {
+	current := filepath.Join(config.PKG_OPT, name, "current")
+	wanted, err := linkedFiles(versionPrefix(name, ver))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := tx.link(current, ver); err != nil {
+		return nil, nil, err
+	}
+	links := map[string]string{}
+	for _, file := range wanted {
+		target := filepath.Join(current, file)
+		if err := tx.link(filepath.Join(config.PKG_HOME, file), target); err != nil {
+			return nil, nil, err
+		}
+		links[file] = target
+	}
+
+	for _, file := range previousFiles {
+		if _, ok := links[file]; isLinked(file) && !ok {
+			if err := tx.backup(file); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	files := append(wanted, filepath.Join("opt", name))
+	slices.Sort(files)
+	return files, links, nil
+}
+
+// Records every file a package owns, given the top-level files returned by
+// activate. The versions in opt/<name> are only read again if they weren't
+// recorded in previous or are fresh, so that switching or adding a version
+// doesn't hash every other installed version again.
+func recordFiles(name string, files []string, previous []config.File, fresh string) ([]config.File, error) {
+	pkgDir := filepath.Join("opt", name)
+	records := []config.File{}
+	toRead := []string{}
+	for _, file := range files {
+		if file != pkgDir {
+			toRead = append(toRead, file)
+			continue
+		}
+
+		record, err := config.Stat(pkgDir)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+		entries, err := os.ReadDir(filepath.Join(config.PKG_HOME, pkgDir))
+		if err != nil {
+			return nil, fmt.Errorf("Error listing %s directory: %v\n", pkgDir, err)
+		}
+		for _, entry := range entries {
+			path := filepath.Join(pkgDir, entry.Name())
+			recorded := slices.ContainsFunc(previous, func(f config.File) bool { return f.Path == path })
+			if entry.Name() == "current" || entry.Name() == fresh || !recorded {
+				toRead = append(toRead, path)
+				continue
+			}
+			for _, f := range previous {
+				if isWithin(f.Path, path) {
+					records = append(records, f)
+				}
+			}
+		}
+	}
+
+	read, err := config.Snapshot(toRead...)
+	if err != nil {
+		return nil, err
+	}
+	records = append(records, read...)
+	config.SortFiles(records)
+	return records, nil
+}
+
+// Lists the files in a prefix that are linked into PKG_HOME when it's
+// activated, relative to the prefix
+func linkedFiles(prefix string) ([]string, error) {
+	files := []string{}
+	for _, pattern := range linkedDirs {
+		dirs, err := filepath.Glob(filepath.Join(prefix, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("Error listing %s directory: %v\n", pattern, err)
+		}
+		for _, dir := range dirs {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				return nil, fmt.Errorf("Error listing %s directory: %v\n", dir, err)
+			}
+			for _, entry := range entries {
+				file, _ := filepath.Rel(prefix, filepath.Join(dir, entry.Name()))
+				files = append(files, file)
+			}
+		}
+	}
+	return files, nil
+}
+
+// Checks that none of the files a package is about to own in PKG_HOME belong
+// to another package. Conflicting files are taken over if the transaction
+// allows overwriting, moving anything of the other package's that's in the
+// way out of it. Returns the files that were taken over and who they belonged
+// to.
+func (tx *transaction) claim(name string, files []string) (map[string]string, error) {
+	// files owned by other packages, and their owners
+	conflicts := map[string]string{}
+	for _, installed := range slices.Sorted(maps.Keys(tx.lockfile)) {
+		if installed == name {
+			continue
+		}
+		for _, owned := range config.Roots(tx.lockfile[installed].Files) {
+			if slices.ContainsFunc(files, func(file string) bool { return isWithin(file, owned) || isWithin(owned, file) }) {
+				conflicts[owned] = installed
+			}
+		}
+	}
+	if len(conflicts) == 0 {
+		return conflicts, nil
+	}
+	if !tx.overwrite {
+		return nil, ErrorFileConflict{Name: name, Conflicts: conflicts}
+	}
+
+	for _, owned := range slices.Sorted(maps.Keys(conflicts)) {
+		owner := conflicts[owned]
+		log.Printf("Taking over %s from %s\n", owned, owner)
+		entry := tx.lockfile[owner]
+		entry.Files = slices.DeleteFunc(slices.Clone(entry.Files), func(file config.File) bool { return isWithin(file.Path, owned) })
+		entry.Links = maps.Clone(entry.Links)
+		delete(entry.Links, owned)
+		tx.lockfile[owner] = entry
+
+		// links are replaced when the package is activated, anything else has to
+		// make way for the package's own files
+		if !slices.Contains(files, owned) {
+			if err := tx.backup(owned); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return conflicts, nil
+}
+
+// Whether a file owned by a package is one of the links into its active version
+func isLinked(file string) bool {
+	return slices.ContainsFunc(linkedDirs, func(pattern string) bool {
+		ok, _ := filepath.Match(pattern, filepath.Dir(file))
+		return ok
+	})
+}
+
+// Points the symlink at path to target. An existing symlink is replaced
+// atomically, so that the path never goes missing, while anything else at
+// path is backed up first.
+func (tx *transaction) link(path, target string) error {
+	info, err := os.Lstat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error reading %s: %v\n", path, err)
+	}
+	replaced := ""
+	if err == nil {
+		if info.Mode()&os.ModeSymlink == 0 {
+			rel, _ := filepath.Rel(config.PKG_HOME, path)
+			if err := tx.backup(rel); err != nil {
+				return err
+			}
+		} else {
+			oldTarget, err := os.Readlink(path)
+			if err != nil {
+				return fmt.Errorf("Error reading link %s: %v\n", path, err)
+			}
+			if oldTarget == target {
+				return nil
+			}
+			// keep a copy of the old link to put back over the new one when
+			// rolling back
+			replaced = filepath.Join(tx.dir, "backup", strconv.Itoa(len(tx.journal.Moves)), filepath.Base(path))
+			if err := os.MkdirAll(filepath.Dir(replaced), 0o755); err != nil {
+				return fmt.Errorf("Error creating %s: %v\n", filepath.Dir(replaced), err)
+			}
+			if err := os.Symlink(oldTarget, replaced); err != nil {
+				return fmt.Errorf("Error backing up link %s: %v\n", path, err)
+			}
+		}
+	}
+
+	tmp := filepath.Join(tx.dir, "links", strconv.Itoa(len(tx.journal.Moves)))
+	if err := os.MkdirAll(filepath.Dir(tmp), 0o755); err != nil {
+		return fmt.Errorf("Error creating %s: %v\n", filepath.Dir(tmp), err)
+	}
+	if err := os.Symlink(target, tmp); err != nil {
+		return fmt.Errorf("Error creating link %s: %v\n", path, err)
+	}
+	return tx.moveReplacing(tmp, path, replaced)
+}
+
+// Moves a file, journaling the move first so that it can be undone even if we
+// crash straight after
+func (tx *transaction) move(from, to string) error {
+	return tx.moveReplacing(from, to, "")
+}
+
+// Moves a file over whatever is at to, where replaced is a copy of what was
+// there that undoing the move puts back
+func (tx *transaction) moveReplacing(from, to, replaced string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0o755); err != nil {
+		return fmt.Errorf("Error creating %s: %v\n", filepath.Dir(to), err)
+	}
+
+	if err := tx.journal.Append(config.JournalMove{From: from, To: to, Replaced: replaced}); err != nil {
+		return err
+	}
+	if err := os.Rename(from, to); err != nil {
+		tx.journal.Moves = tx.journal.Moves[:len(tx.journal.Moves)-1]
+		return fmt.Errorf("Error moving %s to %s: %v\n", from, to, err)
+	}
+	return nil
+}
+
+// Keeps all changes made in the transaction and writes the lockfile
+func (tx *transaction) commit() error {
+	defer tx.stop()
+	return tx.journal.Commit(tx.lockfile)
+}
+
+// Undoes all changes made in the transaction, restoring PKG_HOME and the
+// lockfile to the state they were in when the transaction began
+func (tx *transaction) rollback() error {
+	defer tx.stop()
+	log.Printf("Rolling back changes...\n")
+
+	maps.DeleteFunc(tx.lockfile, func(string, config.LockfilePackage) bool { return true })
+	maps.Copy(tx.lockfile, tx.journal.Snapshot.Clone())
+
+	if err := tx.journal.Undo(); err != nil {
+		// keep the journal and transaction directory around so nothing is lost,
+		// and the next run can try again
+		return fmt.Errorf("Error rolling back, leftover files are in %s:\n%v", tx.dir, err)
+	}
+	return tx.journal.Finish()
+}
+
+// Runs fn in a new transaction, which is committed if fn succeeds and rolled
+// back otherwise
+func withTransaction(lockfile config.Lockfile, fn func(tx *transaction) error) error {
+	tx, err := beginTransaction(lockfile)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		if rbErr := tx.rollback(); rbErr != nil {
+			return fmt.Errorf("%v\n%v", err, rbErr)
+		}
+		return err
+	}
+	return tx.commit()
+}
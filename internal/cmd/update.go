@@ -1,78 +1,277 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
-	"path"
-	"path/filepath"
+	"maps"
+	"slices"
+	"strings"
 
 	"github.com/pkg-mngr/pkg/internal/config"
+	"github.com/pkg-mngr/pkg/internal/log"
 	"github.com/pkg-mngr/pkg/internal/manifest"
 	"github.com/pkg-mngr/pkg/internal/util"
+	"github.com/pkg-mngr/pkg/internal/version"
 )
 
-func Update(pkgs []string, skipConfirmation bool, lockfile config.Lockfile) error {
-	allUpToDate := true
+const (
+	UpdateUpdated = "updated"
+	// Installed as a new dependency of an updated package
+	UpdateInstalled = "installed"
+	UpdateCurrent   = "current"
+	UpdateFailed    = "failed"
+	UpdateSkipped   = "skipped"
+)
+
+// What updating a package did
+type UpdateResult struct {
+	Name   string
+	Status string
+	// The version before the update, empty for new dependencies
+	From string
+	// The version after the update, or the version it would have been updated
+	// to if it failed or was skipped
+	To     string
+	Reason string
+}
 
+// Updates packages to their latest versions allowed by their pins. Their
+// manifests are fetched at once, as are their downloads, before they're
+// installed one at a time. A package that fails to update is left at its
+// previous version, and the rest are still updated. With dryRun, prints what
+// would be updated instead, recording it only in the in-memory lockfile.
+// Returns what happened to every package that was updated, or that was
+// checked for an update, sorted by name. If interrupted, stops without
+// updating the rest, returning what happened so far along with
+// ErrorInterrupted.
+func Update(pkgs []string, skipConfirmation, allowDowngrade, overwrite, dryRun bool, lockfile config.Lockfile) ([]UpdateResult, error) {
 	for _, pkg := range pkgs {
 		if _, ok := lockfile[pkg]; !ok {
-			return ErrorPackageNotInstalled{Name: pkg}
+			return nil, ErrorPackageNotInstalled{Name: pkg}
+		}
+	}
+
+	before := lockfile.Clone()
+	results := map[string]UpdateResult{}
+	fail := func(pkg, to string, err error) {
+		log.Errorf("Error updating %s: %v\n", pkg, strings.TrimSpace(err.Error()))
+		results[pkg] = UpdateResult{Name: pkg, Status: UpdateFailed, From: lockfile[pkg].Version, To: to, Reason: err.Error()}
+	}
+	sorted := func() []UpdateResult {
+		return slices.SortedFunc(maps.Values(results), func(a, b UpdateResult) int { return strings.Compare(a.Name, b.Name) })
+	}
+	// the latest version of each pinned package whose latest version is outside
+	// its pin
+	heldBack := map[string]string{}
+
+	checks := util.ParallelMap(pkgs, config.JOBS, func(pkg string, _ int) updateCheck {
+		return checkUpdate(lockfile[pkg])
+	})
+	plans := map[string]plan{}
+	for i, pkg := range pkgs {
+		check := checks[i]
+		installed := lockfile[pkg].Version
+		if check.HeldBack != "" {
+			heldBack[pkg] = check.HeldBack
+		}
+		if check.Err != nil {
+			fail(pkg, check.Manifest.Version, check.Err)
+			continue
 		}
+		if check.Manifest.Version == "" {
+			results[pkg] = UpdateResult{Name: pkg, Status: UpdateSkipped, From: installed, To: check.HeldBack,
+				Reason: fmt.Sprintf("pinned to %s", lockfile[pkg].Pin)}
+			continue
+		}
+		pkgManifest := check.Manifest
 
-		manifestUrl := lockfile[pkg].Manifest
-		var pkgManifest manifest.Manifest
-		if manifest.IsLocalFile(manifestUrl) {
-			manifestJson, err := manifest.FromFile(manifestUrl)
-			if err != nil {
-				return err
+		// only move forward, so that a registry rolling back a manifest doesn't
+		// silently downgrade packages
+		switch version.Diff(installed, pkgManifest.Version) {
+		case version.Same:
+			result := UpdateResult{Name: pkg, Status: UpdateCurrent, From: installed, To: installed}
+			if check.HeldBack != "" {
+				result.Reason = fmt.Sprintf("pinned to %s, %s available", lockfile[pkg].Pin, check.HeldBack)
 			}
-			processed, err := manifestJson.Process()
-			if err != nil {
-				return err
+			results[pkg] = result
+			continue
+		case version.Downgrade:
+			if !allowDowngrade {
+				log.Printf("Skipping %s: available version %s is older than installed version %s\n",
+					pkg, pkgManifest.Version, installed)
+				results[pkg] = UpdateResult{Name: pkg, Status: UpdateSkipped, From: installed, To: pkgManifest.Version,
+					Reason: "available version is older, use --allow-downgrade to update anyway"}
+				continue
 			}
-			pkgManifest = processed
-		} else {
-			manifestJson, err := manifest.FromRemote(manifestUrl)
-			if err != nil {
-				return err
+		}
+
+		// a dry run plans any upgrades of dependencies without asking
+		updatePlan, err := resolve([]manifest.Manifest{pkgManifest}, lockfile, skipConfirmation || dryRun)
+		if err != nil {
+			fail(pkg, pkgManifest.Version, err)
+			continue
+		}
+		updatePlan.print()
+		if !dryRun {
+			if err := updatePlan.checkOffline(); err != nil {
+				fail(pkg, pkgManifest.Version, err)
+				continue
 			}
-			processed, err := manifestJson.Process()
-			if err != nil {
-				return err
+		}
+		plans[pkg] = updatePlan
+	}
+
+	failed := map[string]error{}
+	if !dryRun {
+		ordered := []plan{}
+		for _, pkg := range pkgs {
+			if updatePlan, ok := plans[pkg]; ok {
+				ordered = append(ordered, updatePlan)
 			}
-			pkgManifest = processed
 		}
+		var err error
+		if failed, err = prefetch(ordered...); err != nil {
+			skipInterrupted(pkgs, plans, results)
+			return sorted(), err
+		}
+	}
 
-		if pkgManifest.Version == lockfile[pkg].Version {
+	for _, pkg := range pkgs {
+		updatePlan, ok := plans[pkg]
+		if !ok {
+			continue
+		}
+		// the package itself comes last in its plan, after its dependencies
+		to := updatePlan[len(updatePlan)-1].Manifest.Version
+		// earlier plans may have installed some of this one already
+		updatePlan = updatePlan.refresh(lockfile)
+		if len(updatePlan) == 0 {
+			continue
+		}
+		if dryRun {
+			updatePlan.dryRun(lockfile)
+			updatePlan.record(results)
+			continue
+		}
+		if err := updatePlan.prefetchErr(failed); err != nil {
+			fail(pkg, to, err)
 			continue
 		}
 
-		allUpToDate = false
-		fmt.Printf("Updating %s...\n", pkg)
-
-		filename := filepath.Join(config.PKG_TMP, path.Base(pkgManifest.Url))
+		// the previous version is only replaced once the new one has been
+		// downloaded, verified and installed successfully, and is restored if
+		// anything fails, along with the rest of the plan
+		err := withTransaction(lockfile, func(tx *transaction) error {
+			tx.overwrite = overwrite
+			return updatePlan.install(tx, skipConfirmation)
+		})
+		errInterrupted := ErrorInterrupted{}
+		errCancelled := util.ErrorScriptCancelled{}
+		switch {
+		case errors.As(err, &errInterrupted):
+			fail(pkg, to, err)
+			skipInterrupted(pkgs, plans, results)
+			return sorted(), err
+		case errors.As(err, &errCancelled):
+			results[pkg] = UpdateResult{Name: pkg, Status: UpdateSkipped, From: lockfile[pkg].Version, To: to, Reason: err.Error()}
+			continue
+		case err != nil:
+			fail(pkg, to, err)
+			continue
+		}
+		updatePlan.record(results)
+	}
 
-		// download file and verify checksum
-		if err := util.Fetch(pkgManifest.Url, filename, pkgManifest.Name); err != nil {
-			return err
+	if len(heldBack) > 0 {
+		fmt.Println("\n\033[33;1m===\033[0;1m Held back\033[0m")
+		for _, pkg := range slices.Sorted(maps.Keys(heldBack)) {
+			fmt.Printf("  \033[1m%s:\033[0m %s (pinned to %s, %s available)\n",
+				pkg, lockfile[pkg].Version, lockfile[pkg].Pin, heldBack[pkg])
 		}
-		if err := util.VerifyChecksum(filename, pkgManifest.Sha256, pkgManifest.Name); err != nil {
-			return err
+		fmt.Println()
+	}
+	if dryRun && len(plans) > 0 {
+		printLockfileDiff(before, lockfile)
+	}
+
+	return sorted(), nil
+}
+
+// Records the packages that were going to be updated when an update was
+// interrupted as skipped
+func skipInterrupted(pkgs []string, plans map[string]plan, results map[string]UpdateResult) {
+	for _, pkg := range pkgs {
+		updatePlan, ok := plans[pkg]
+		if _, done := results[pkg]; !ok || done {
+			continue
 		}
+		results[pkg] = UpdateResult{Name: pkg, Status: UpdateSkipped, From: updatePlan[len(updatePlan)-1].Previous.Version,
+			To: updatePlan[len(updatePlan)-1].Manifest.Version, Reason: "interrupted"}
+	}
+}
 
-		// if previous steps were successful, remove existing package
-		if err := Remove(pkg, lockfile, true); err != nil {
-			return err
+// The version a package can be updated to
+type updateCheck struct {
+	// The manifest of the newest version allowed by the package's pin, empty if
+	// the manifest host doesn't publish one
+	Manifest manifest.Manifest
+	// The latest version, if it's outside the package's pin
+	HeldBack string
+	Err      error
+}
+
+func checkUpdate(entry config.LockfilePackage) updateCheck {
+	latest, err := manifest.GetUrl(entry.Manifest)
+	if err != nil {
+		return updateCheck{Err: err}
+	}
+	check := updateCheck{Manifest: latest}
+	if entry.Pin == "" {
+		return check
+	}
+
+	// pinned packages only move to the newest version allowed by their pin
+	pin, err := version.ParseConstraints(entry.Pin)
+	if err != nil {
+		check.Err = err
+		return check
+	}
+	if !pin.Check(latest.Version) {
+		check.HeldBack = latest.Version
+		check.Manifest = manifest.Manifest{}
+		if matching, err := manifest.GetMatching(entry.Manifest, pin); err == nil {
+			check.Manifest = matching
 		}
+	}
+	return check
+}
 
-		// resume installation after removing old version
-		if err := install(lockfile, pkgManifest, skipConfirmation); err != nil {
-			return err
+// Records every package in an installed plan as updated, or installed if it's
+// a new dependency
+func (p plan) record(results map[string]UpdateResult) {
+	for _, node := range p {
+		result := UpdateResult{Name: node.Manifest.Name, Status: UpdateInstalled, To: node.Manifest.Version}
+		if node.Previous != nil {
+			result.Status = UpdateUpdated
+			result.From = node.Previous.Version
 		}
-		fmt.Printf("Finished updating %s\n", pkg)
+		results[node.Manifest.Name] = result
 	}
+}
 
-	if allUpToDate {
-		fmt.Println("All packages are up to date")
+// Renders the results of an update as the rows of a table, with the first
+// line of the reason each package failed or was skipped
+func UpdateTable(results []UpdateResult) []string {
+	rows := [][]string{{"Package", "Status", "Version", "Reason"}}
+	for _, result := range results {
+		versions := result.To
+		if result.From != "" && result.To != "" && result.From != result.To {
+			versions = fmt.Sprintf("%s -> %s", result.From, result.To)
+		} else if result.From != "" {
+			versions = result.From
+		}
+		reason, _, _ := strings.Cut(strings.TrimSpace(result.Reason), "\n")
+		rows = append(rows, []string{result.Name, result.Status, versions, reason})
 	}
-	return nil
+	return renderTable(rows)
 }
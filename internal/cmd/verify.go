@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/pkg-mngr/pkg/internal/config"
+	"github.com/pkg-mngr/pkg/internal/manifest"
+)
+
+// A file of an installed package that no longer matches what was recorded
+// when it was installed
+type FileProblem struct {
+	Path, Problem string
+}
+
+func (p FileProblem) String() string {
+	return fmt.Sprintf("%s: %s", p.Path, p.Problem)
+}
+
+// Checks the files of each package against what was recorded when it was
+// installed. Returns the problems found for each package that has any.
+func Verify(pkgs []string, lockfile config.Lockfile) (map[string][]FileProblem, error) {
+	problems := map[string][]FileProblem{}
+	for _, pkg := range pkgs {
+		entry, ok := lockfile[pkg]
+		if !ok {
+			return nil, ErrorPackageNotInstalled{Name: pkg}
+		}
+		for _, file := range entry.Files {
+			problem, err := verifyFile(file)
+			if err != nil {
+				return nil, err
+			}
+			if problem != "" {
+				problems[pkg] = append(problems[pkg], FileProblem{Path: file.Path, Problem: problem})
+			}
+		}
+	}
+	return problems, nil
+}
+
+// Returns what's wrong with an installed file, or nothing if it's unchanged
+func verifyFile(file config.File) (string, error) {
+	path := filepath.Join(config.PKG_HOME, file.Path)
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return "missing", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("Error reading %s: %v\n", file.Path, err)
+	}
+	// lockfiles written before file details were recorded only have the path
+	if file.Type == "" {
+		return "", nil
+	}
+
+	fileType := config.FileTypeFile
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		fileType = config.FileTypeSymlink
+	case info.IsDir():
+		fileType = config.FileTypeDir
+	}
+	if fileType != file.Type {
+		return fmt.Sprintf("changed from a %s to a %s", file.Type, fileType), nil
+	}
+
+	switch file.Type {
+	case config.FileTypeSymlink:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", fmt.Errorf("Error reading link %s: %v\n", file.Path, err)
+		}
+		if target != file.Target {
+			return fmt.Sprintf("points to %s instead of %s", target, file.Target), nil
+		}
+		return "", nil
+	case config.FileTypeFile:
+		sum, err := config.HashFile(path)
+		if err != nil {
+			return "", err
+		}
+		if sum != file.Sha256 {
+			return "modified", nil
+		}
+	}
+
+	if mode := fmt.Sprintf("%04o", info.Mode().Perm()); mode != file.Mode {
+		return fmt.Sprintf("permissions changed from %s to %s", file.Mode, mode), nil
+	}
+	return "", nil
+}
+
+// Reinstalls the versions of packages that have problems, downloading and
+// verifying them again. Every package is repaired in one transaction, so if
+// any of them fails, none of them are changed.
+func Repair(problems map[string][]FileProblem, skipConfirmation bool, lockfile config.Lockfile) error {
+	installPlan := plan{}
+	// the versions that were active, to switch back to after reinstalling
+	// other versions
+	active := map[string]string{}
+	for _, pkg := range slices.Sorted(maps.Keys(problems)) {
+		entry := lockfile[pkg]
+		active[pkg] = entry.Version
+		for _, ver := range brokenVersions(pkg, entry, problems[pkg]) {
+			pkgManifest, err := manifestVersion(entry.Manifest, ver)
+			if err != nil {
+				return err
+			}
+			installPlan = append(installPlan, planNode{
+				Manifest:     pkgManifest,
+				Dependencies: entry.Dependencies,
+				KeepPrevious: true,
+			})
+		}
+	}
+
+	installPlan.print()
+	if err := installPlan.checkOffline(); err != nil {
+		return err
+	}
+
+	return withTransaction(lockfile, func(tx *transaction) error {
+		for _, node := range installPlan {
+			fmt.Printf("Reinstalling %s %s...\n", node.Manifest.Name, node.Manifest.Version)
+			previous := tx.lockfile[node.Manifest.Name]
+			node.Previous = &previous
+			if err := download(tx, &node.Manifest); err != nil {
+				return err
+			}
+			if err := install(tx, node, skipConfirmation); err != nil {
+				return fmt.Errorf("%s: %w", node.Manifest.Name, err)
+			}
+		}
+		for _, pkg := range slices.Sorted(maps.Keys(active)) {
+			if tx.lockfile[pkg].Version == active[pkg] {
+				continue
+			}
+			if err := tx.switchTo(pkg, active[pkg]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Returns the installed versions that have to be reinstalled to fix problems
+// with a package's files, with the active version last so that it ends up
+// active again
+func brokenVersions(pkg string, entry config.LockfilePackage, problems []FileProblem) []string {
+	versions := []string{}
+	for _, problem := range problems {
+		ver := entry.Version
+		// problems inside one of the versions only need that version to be
+		// reinstalled, links into the active version need the active version
+		for _, v := range entry.Versions {
+			if isWithin(problem.Path, filepath.Join("opt", pkg, v)) {
+				ver = v
+			}
+		}
+		if !slices.Contains(versions, ver) {
+			versions = append(versions, ver)
+		}
+	}
+	if i := slices.Index(versions, entry.Version); i != -1 {
+		versions = append(slices.Delete(versions, i, i+1), entry.Version)
+	}
+	return versions
+}
+
+// Gets the manifest for a version of the package whose manifest is at url
+func manifestVersion(url, ver string) (manifest.Manifest, error) {
+	pkgManifest, err := manifest.GetUrl(url)
+	if err == nil && pkgManifest.Version == ver {
+		return pkgManifest, nil
+	}
+	return manifest.GetVersion(url, ver)
+}
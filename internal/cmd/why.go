@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/pkg-mngr/pkg/internal/config"
+)
+
+// Why a package is installed
+type WhyResult struct {
+	Package string `json:"package"`
+	Reason  string `json:"reason"`
+	// Every chain of dependents leading to the package, each starting from an
+	// explicitly installed package, or one that nothing depends on, and ending
+	// with the package itself
+	Chains [][]string `json:"chains"`
+}
+
+func (w WhyResult) String() string {
+	output := ""
+	if w.Reason == config.ReasonExplicit {
+		output += fmt.Sprintf("%s was installed explicitly\n", w.Package)
+	}
+	for _, chain := range w.Chains {
+		output += strings.Join(chain, " -> ") + "\n"
+	}
+	if w.Reason == config.ReasonDependency && len(w.Chains) == 0 {
+		output += fmt.Sprintf("%s was installed as a dependency, but nothing needs it any more\n", w.Package)
+	}
+	return strings.TrimSuffix(output, "\n")
+}
+
+func Why(pkg string, lockfile config.Lockfile) (WhyResult, error) {
+	entry, ok := lockfile[pkg]
+	if !ok {
+		return WhyResult{}, ErrorPackageNotInstalled{Name: pkg}
+	}
+	return WhyResult{Package: pkg, Reason: entry.Reason, Chains: dependentChains(pkg, nil, lockfile)}, nil
+}
+
+// Returns every chain of dependents leading to pkg, skipping packages already
+// in path to stop at dependency cycles
+func dependentChains(pkg string, path []string, lockfile config.Lockfile) [][]string {
+	path = append(path, pkg)
+	chains := [][]string{}
+	if len(path) > 1 && (lockfile[pkg].Reason == config.ReasonExplicit || len(dependents(pkg, lockfile)) == 0) {
+		chains = append(chains, []string{pkg})
+	}
+	for _, dependent := range dependents(pkg, lockfile) {
+		if slices.Contains(path, dependent) {
+			continue
+		}
+		for _, chain := range dependentChains(dependent, path, lockfile) {
+			chains = append(chains, append(chain, pkg))
+		}
+	}
+	return chains
+}
+
+// Returns the installed packages that depend on pkg
+func dependents(pkg string, lockfile config.Lockfile) []string {
+	dependents := []string{}
+	for _, installed := range slices.Sorted(maps.Keys(lockfile)) {
+		if slices.Contains(lockfile[installed].Dependencies, pkg) {
+			dependents = append(dependents, installed)
+		}
+	}
+	return dependents
+}
+
+// An installed package and the packages it depends on
+type TreeNode struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	// Whether the package is a dependency that isn't installed
+	Missing bool `json:"missing,omitempty"`
+	// Whether the package is one of its own dependencies, so its dependencies
+	// are left out
+	Cycle        bool       `json:"cycle,omitempty"`
+	Dependencies []TreeNode `json:"dependencies,omitempty"`
+}
+
+// Returns the installed packages as a forest of dependencies, rooted at the
+// packages that nothing depends on
+func ListTree(lockfile config.Lockfile) []TreeNode {
+	roots := []TreeNode{}
+	for _, pkg := range slices.Sorted(maps.Keys(lockfile)) {
+		if lockfile[pkg].Reason == config.ReasonExplicit || len(dependents(pkg, lockfile)) == 0 {
+			roots = append(roots, treeNode(pkg, nil, lockfile))
+		}
+	}
+	return roots
+}
+
+// Returns the installed packages without their dependencies
+func ListFlat(lockfile config.Lockfile) []TreeNode {
+	nodes := []TreeNode{}
+	for _, pkg := range slices.Sorted(maps.Keys(lockfile)) {
+		nodes = append(nodes, TreeNode{Name: pkg, Version: lockfile[pkg].Version, Reason: lockfile[pkg].Reason})
+	}
+	return nodes
+}
+
+func treeNode(pkg string, path []string, lockfile config.Lockfile) TreeNode {
+	entry, ok := lockfile[pkg]
+	if !ok {
+		return TreeNode{Name: pkg, Missing: true}
+	}
+	node := TreeNode{Name: pkg, Version: entry.Version, Reason: entry.Reason}
+	if slices.Contains(path, pkg) {
+		node.Cycle = true
+		return node
+	}
+	for _, dep := range entry.Dependencies {
+		node.Dependencies = append(node.Dependencies, treeNode(dep, append(path, pkg), lockfile))
+	}
+	return node
+}
+
+// Renders a forest of packages as lines of a tree
+func RenderTree(nodes []TreeNode) []string {
+	lines := []string{}
+	for _, node := range nodes {
+		lines = append(lines, node.line())
+		lines = append(lines, renderChildren(node.Dependencies, "")...)
+	}
+	return lines
+}
+
+func renderChildren(nodes []TreeNode, indent string) []string {
+	lines := []string{}
+	for i, node := range nodes {
+		branch, childIndent := "├── ", "│   "
+		if i == len(nodes)-1 {
+			branch, childIndent = "└── ", "    "
+		}
+		lines = append(lines, indent+branch+node.line())
+		lines = append(lines, renderChildren(node.Dependencies, indent+childIndent)...)
+	}
+	return lines
+}
+
+func (node TreeNode) line() string {
+	switch {
+	case node.Missing:
+		return fmt.Sprintf("\033[1m%s\033[0m \033[31m(not installed)\033[0m", node.Name)
+	case node.Cycle:
+		return fmt.Sprintf("\033[1m%s:\033[0m %s (dependency cycle)", node.Name, node.Version)
+	}
+	return fmt.Sprintf("\033[1m%s:\033[0m %s", node.Name, node.Version)
+}
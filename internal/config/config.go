@@ -3,18 +3,32 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"strconv"
 
 	"github.com/pkg-mngr/pkg/internal/log"
 )
 
 var (
-	PKG_HOME            = getPkgHome()
-	PKG_BIN             = filepath.Join(PKG_HOME, "bin")
-	PKG_OPT             = filepath.Join(PKG_HOME, "opt")
-	PKG_TMP             = filepath.Join(PKG_HOME, "tmp")
+	PKG_HOME  = getPkgHome()
+	PKG_BIN   = filepath.Join(PKG_HOME, "bin")
+	PKG_OPT   = filepath.Join(PKG_HOME, "opt")
+	PKG_TMP   = filepath.Join(PKG_HOME, "tmp")
+	PKG_CACHE = filepath.Join(PKG_HOME, "cache")
+	// Downloads that didn't match their checksums are kept here for inspection
+	PKG_QUARANTINE      = filepath.Join(PKG_HOME, "quarantine")
 	LOCKFILE            = filepath.Join(PKG_HOME, "pkg.lock")
+	LOCKFILE_BACKUP     = filepath.Join(PKG_HOME, "pkg.lock.bak")
+	JOURNAL             = filepath.Join(PKG_HOME, "pkg.journal")
+	PID_FILE            = filepath.Join(PKG_HOME, "pkg.pid")
 	PKG_ZSH_COMPLETIONS = filepath.Join(PKG_HOME, "share/zsh/site-functions")
 	MANIFEST_HOST       = getManifestHost()
+	// Whether to work only from the cache, without accessing the network
+	OFFLINE = getOffline()
+	// How many manifests and downloads are fetched at once
+	JOBS = getJobs()
+	// Whether to show what would be done without changing anything in PKG_HOME,
+	// including the cache
+	DRY_RUN = false
 )
 
 func getPkgHome() string {
@@ -47,3 +61,19 @@ func getManifestHost() string {
 
 	return "https://pkg.zerolimits.dev"
 }
+
+// The default number of manifests and downloads fetched at once
+const DEFAULT_JOBS = 4
+
+func getJobs() int {
+	jobs, err := strconv.Atoi(os.Getenv("PKG_JOBS"))
+	if err != nil || jobs < 1 {
+		return DEFAULT_JOBS
+	}
+	return jobs
+}
+
+func getOffline() bool {
+	offline, err := strconv.ParseBool(os.Getenv("PKG_OFFLINE"))
+	return err == nil && offline
+}
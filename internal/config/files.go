@@ -0,0 +1,174 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	FileTypeFile    = "file"
+	FileTypeDir     = "dir"
+	FileTypeSymlink = "symlink"
+)
+
+// A file owned by a package, with its path relative to PKG_HOME
+type File struct {
+	Path   string `json:"path"`
+	Type   string `json:"type,omitempty"`
+	Target string `json:"target,omitempty"`
+	Mode   string `json:"mode,omitempty"`
+	Sha256 string `json:"sha256,omitempty"`
+}
+
+// Lockfiles written before file details were recorded list files as plain
+// paths, which are read as files with only a path
+func (f *File) UnmarshalJSON(data []byte) error {
+	var path string
+	if err := json.Unmarshal(data, &path); err == nil {
+		*f = File{Path: path}
+		return nil
+	}
+	type file File
+	return json.Unmarshal(data, (*file)(f))
+}
+
+// Records a single file relative to PKG_HOME, without descending into it if
+// it's a directory
+func Stat(path string) (File, error) {
+	info, err := os.Lstat(filepath.Join(PKG_HOME, path))
+	if err != nil {
+		return File{}, fmt.Errorf("Error reading %s: %v\n", path, err)
+	}
+	f, hash, err := record(path, info)
+	if err != nil || !hash {
+		return f, err
+	}
+	f.Sha256, err = HashFile(filepath.Join(PKG_HOME, path))
+	return f, err
+}
+
+// Records every file under each of paths, which are relative to PKG_HOME.
+// Files are hashed in parallel, since toolchains like go and zig have
+// thousands of them.
+func Snapshot(paths ...string) ([]File, error) {
+	files := []File{}
+	toHash := []int{}
+	for _, root := range paths {
+		err := filepath.WalkDir(filepath.Join(PKG_HOME, root), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(PKG_HOME, path)
+			f, hash, err := record(rel, info)
+			if err != nil {
+				return err
+			}
+			if hash {
+				toHash = append(toHash, len(files))
+			}
+			files = append(files, f)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s: %v\n", root, err)
+		}
+	}
+
+	jobs := make(chan int)
+	errs := make([]error, len(files))
+	var wg sync.WaitGroup
+	for range runtime.NumCPU() {
+		wg.Go(func() {
+			for i := range jobs {
+				files[i].Sha256, errs[i] = HashFile(filepath.Join(PKG_HOME, files[i].Path))
+			}
+		})
+	}
+	for _, i := range toHash {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	SortFiles(files)
+	return files, nil
+}
+
+// Returns the record for a file, and whether it needs to be hashed
+func record(path string, info fs.FileInfo) (File, bool, error) {
+	f := File{Path: path, Mode: fmt.Sprintf("%04o", info.Mode().Perm())}
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		target, err := os.Readlink(filepath.Join(PKG_HOME, path))
+		if err != nil {
+			return File{}, false, fmt.Errorf("Error reading link %s: %v\n", path, err)
+		}
+		// the permissions of symlinks are meaningless
+		return File{Path: path, Type: FileTypeSymlink, Target: target}, false, nil
+	case info.IsDir():
+		f.Type = FileTypeDir
+		return f, false, nil
+	}
+	f.Type = FileTypeFile
+	return f, true, nil
+}
+
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("Error reading %s: %v\n", path, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("Error reading %s: %v\n", path, err)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// Sorts files by path, with each directory directly followed by its contents
+func SortFiles(files []File) {
+	slices.SortFunc(files, func(a, b File) int { return compareFilePaths(a.Path, b.Path) })
+}
+
+func compareFilePaths(a, b string) int {
+	return strings.Compare(strings.ReplaceAll(a, "/", "\x00"), strings.ReplaceAll(b, "/", "\x00"))
+}
+
+// Returns the paths of the files that aren't inside any of the other files,
+// which are enough to remove them all or to check what they conflict with
+func Roots(files []File) []string {
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = f.Path
+	}
+	slices.SortFunc(paths, compareFilePaths)
+
+	roots := []string{}
+	for _, path := range paths {
+		if n := len(roots); n > 0 && (path == roots[n-1] || strings.HasPrefix(path, roots[n-1]+"/")) {
+			continue
+		}
+		roots = append(roots, path)
+	}
+	return roots
+}
@@ -1,7 +1,6 @@
 package config
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 
@@ -11,7 +10,7 @@ import (
 var alreadyInitialised = true
 
 func Init() error {
-	err := initDirs(PKG_HOME, PKG_BIN, PKG_OPT, PKG_TMP, PKG_ZSH_COMPLETIONS)
+	err := initDirs(PKG_HOME, PKG_BIN, PKG_OPT, PKG_TMP, PKG_CACHE, PKG_ZSH_COMPLETIONS)
 	if err != nil {
 		return err
 	}
@@ -56,15 +55,6 @@ func initLockfile() error {
 		return nil
 	}
 	alreadyInitialised = false
-	f, err := os.Create(LOCKFILE)
-	if err != nil {
-		return fmt.Errorf("Error creating %s file: %v\n", LOCKFILE, err)
-	}
-	defer f.Close()
 
-	if err := json.NewEncoder(f).Encode(map[string]LockfilePackage{}); err != nil {
-		return fmt.Errorf("Error writing to lockfile: %v\n", err)
-	}
-
-	return nil
+	return Lockfile{}.Write()
 }
@@ -0,0 +1,207 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/pkg-mngr/pkg/internal/log"
+)
+
+// The journal is written to disk before every change a transaction makes to
+// PKG_HOME, so that if pkg crashes or is killed part way through, the next run
+// can either undo the changes or finish committing them. It's written as JSON
+// lines: the snapshot once when the transaction begins, then a line appended
+// for each move, and a last line once it's committed, so that each move only
+// costs writing the move itself.
+type Journal struct {
+	// Directory holding the transaction's working files and backups
+	Dir string
+	// Every file moved by the transaction, in order
+	Moves []JournalMove
+	// The lockfile from before the transaction began
+	Snapshot Lockfile
+	// Set once all changes have been made, along with the resulting lockfile
+	Committed bool
+	Lockfile  Lockfile
+}
+
+type JournalMove struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// A copy of what was at To before the move replaced it, which is moved back
+	// over To to undo the move
+	Replaced string `json:"replaced,omitempty"`
+}
+
+// A line of the journal
+type journalEntry struct {
+	Dir       string       `json:"dir,omitempty"`
+	Snapshot  Lockfile     `json:"snapshot,omitempty"`
+	Move      *JournalMove `json:"move,omitempty"`
+	Committed bool         `json:"committed,omitempty"`
+	Lockfile  Lockfile     `json:"lockfile,omitempty"`
+}
+
+// Writes the journal's first line, replacing any previous journal
+func (j *Journal) Begin() error {
+	if err := WriteFileAtomic(JOURNAL, mustEncode(journalEntry{Dir: j.Dir, Snapshot: j.Snapshot})); err != nil {
+		return fmt.Errorf("Error writing journal: %v\n", err)
+	}
+	return nil
+}
+
+// Records a move, which has to be done after it's recorded
+func (j *Journal) Append(m JournalMove) error {
+	if err := appendEntry(journalEntry{Move: &m}); err != nil {
+		return err
+	}
+	j.Moves = append(j.Moves, m)
+	return nil
+}
+
+func appendEntry(entry journalEntry) error {
+	f, err := os.OpenFile(JOURNAL, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("Error writing journal: %v\n", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(mustEncode(entry)); err != nil {
+		return fmt.Errorf("Error writing journal: %v\n", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("Error writing journal: %v\n", err)
+	}
+	return f.Close()
+}
+
+// Reads the journal back from its lines. A crash while appending a line can
+// leave the last one incomplete, in which case its move never happened.
+func readJournal(data []byte) (*Journal, error) {
+	j := new(Journal)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	for i, line := range lines {
+		entry := journalEntry{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			if i > 0 && i == len(lines)-1 {
+				break
+			}
+			return nil, err
+		}
+		switch {
+		case i == 0:
+			j.Dir = entry.Dir
+			j.Snapshot = entry.Snapshot
+		case entry.Move != nil:
+			j.Moves = append(j.Moves, *entry.Move)
+		case entry.Committed:
+			j.Committed = true
+			j.Lockfile = entry.Lockfile
+		}
+	}
+	// empty lockfiles are left out of the lines
+	if j.Snapshot == nil {
+		j.Snapshot = Lockfile{}
+	}
+	if j.Lockfile == nil {
+		j.Lockfile = Lockfile{}
+	}
+	return j, nil
+}
+
+// Moves every file back to where it was before the transaction, skipping
+// moves that never happened
+func (j *Journal) Undo() error {
+	errs := []string{}
+	for _, m := range slices.Backward(j.Moves) {
+		if m.Replaced != "" {
+			if _, err := os.Lstat(m.Replaced); os.IsNotExist(err) {
+				continue
+			}
+			if err := os.Rename(m.Replaced, m.To); err != nil {
+				errs = append(errs, fmt.Sprintf("Error restoring %s: %v", m.To, err))
+			}
+			continue
+		}
+
+		if _, err := os.Lstat(m.To); os.IsNotExist(err) {
+			continue
+		}
+		if _, err := os.Lstat(m.From); err == nil {
+			errs = append(errs, fmt.Sprintf("Error restoring %s: file already exists", m.From))
+			continue
+		}
+		if err := os.Rename(m.To, m.From); err != nil {
+			errs = append(errs, fmt.Sprintf("Error restoring %s: %v", m.From, err))
+		}
+	}
+	j.Moves = nil
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s\n", strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// Marks the transaction as committed and writes the resulting lockfile
+func (j *Journal) Commit(lockfile Lockfile) error {
+	if err := appendEntry(journalEntry{Committed: true, Lockfile: lockfile}); err != nil {
+		return err
+	}
+	j.Committed = true
+	j.Lockfile = lockfile
+	if err := lockfile.Write(); err != nil {
+		return err
+	}
+	return j.Finish()
+}
+
+// Removes the journal and the transaction directory once the transaction no
+// longer needs to be recovered
+func (j *Journal) Finish() error {
+	if err := os.Remove(JOURNAL); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error removing journal: %v\n", err)
+	}
+	if err := os.RemoveAll(j.Dir); err != nil {
+		return fmt.Errorf("Error deleting %s: %v\n", j.Dir, err)
+	}
+	return nil
+}
+
+// Recovers from a transaction that was left unfinished by a previous run.
+// Committed transactions are finished, anything else is rolled back.
+func RecoverJournal() error {
+	data, err := os.ReadFile(JOURNAL)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading journal: %v\n", err)
+	}
+
+	j, err := readJournal(data)
+	if err != nil {
+		// only the last line can be left incomplete, so this means it was
+		// tampered with
+		return fmt.Errorf("Error unmarshalling journal %s: %v\n", JOURNAL, err)
+	}
+
+	if j.Committed {
+		log.Printf("Finishing interrupted transaction...\n")
+		if err := j.Lockfile.Write(); err != nil {
+			return err
+		}
+		return j.Finish()
+	}
+
+	log.Printf("Rolling back interrupted transaction...\n")
+	if err := j.Undo(); err != nil {
+		return fmt.Errorf("Error rolling back, leftover files are in %s:\n%v", j.Dir, err)
+	}
+	if err := j.Snapshot.Write(); err != nil {
+		return err
+	}
+	return j.Finish()
+}
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg-mngr/pkg/internal/log"
+)
+
+// Takes an exclusive lock on PKG_HOME, so that only one pkg process can make
+// changes at a time. If another process holds the lock, this waits for it to
+// be released, giving up after timeout, or waiting forever if timeout is 0.
+// The returned function releases the lock.
+func Lock(timeout time.Duration) (func(), error) {
+	f, err := os.OpenFile(PID_FILE, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening %s: %v\n", PID_FILE, err)
+	}
+
+	start := time.Now()
+	waiting := false
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			f.Close()
+			return nil, fmt.Errorf("Error locking %s: %v\n", PID_FILE, err)
+		}
+
+		pid := readPid(f)
+		if timeout > 0 && time.Since(start) >= timeout {
+			f.Close()
+			return nil, fmt.Errorf("Timed out waiting for another pkg process (pid %d) to finish\n", pid)
+		}
+		if !waiting {
+			log.Printf("Waiting for another pkg process (pid %d) to finish...\n", pid)
+			waiting = true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// the lock is released by the kernel when a process exits, so a pid left
+	// behind here belongs to a process that crashed or was killed
+	if pid := readPid(f); pid != 0 && pid != os.Getpid() && !processExists(pid) {
+		log.Printf("Taking over stale lock left by pid %d\n", pid)
+	}
+
+	if err := writePid(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Error writing to %s: %v\n", PID_FILE, err)
+	}
+
+	unlock := sync.OnceFunc(func() {
+		f.Truncate(0)
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	})
+	log.AtExit(unlock)
+
+	return unlock, nil
+}
+
+func readPid(f *os.File) int {
+	data := make([]byte, 32)
+	n, _ := f.ReadAt(data, 0)
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data[:n])))
+	return pid
+}
+
+func writePid(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// Returns the pid of the pkg process holding the lock on PKG_HOME, or 0 if it
+// isn't locked
+func LockHolder() int {
+	f, err := os.Open(PID_FILE)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err == nil {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		return 0
+	}
+	return readPid(f)
+}
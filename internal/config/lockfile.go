@@ -3,40 +3,121 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"maps"
 	"os"
+	"slices"
+
+	"github.com/pkg-mngr/pkg/internal/log"
 )
 
 type Lockfile map[string]LockfilePackage
 
+// Why a package was installed
+const (
+	ReasonExplicit   = "explicit"
+	ReasonDependency = "dependency"
+)
+
 type LockfilePackage struct {
-	Manifest     string   `json:"manifest"`
-	Version      string   `json:"version"`
-	Dependencies []string `json:"dependencies,omitempty"`
-	Files        []string `json:"files"`
+	Manifest string `json:"manifest"`
+	// The active version
+	Version string `json:"version"`
+	// Every installed version, side by side in opt/<name>/<version>. Empty for
+	// packages installed before versions could be installed side by side.
+	Versions []string `json:"versions,omitempty"`
+	// The packages this one depends on. Lockfiles written before install
+	// reasons were recorded only list the ones installed for this package.
+	Dependencies []string          `json:"dependencies,omitempty"`
+	Constraints  map[string]string `json:"constraints,omitempty"`
+	// The links in PKG_HOME to the active version, and what they point to
+	Links map[string]string `json:"links,omitempty"`
+	// Files taken over from other packages with --overwrite, and the packages
+	// they belonged to
+	Overwritten map[string]string `json:"overwritten,omitempty"`
+	// Whether the package was installed explicitly or as a dependency, which
+	// decides whether `pkg autoremove` can remove it
+	Reason string `json:"reason"`
+	// Dependencies that were removed with --force while this package still
+	// needed them
+	Broken []string `json:"broken,omitempty"`
+	// The version constraint the package is held to by `pkg pin`
+	Pin string `json:"pin,omitempty"`
+	// Every file the package owns in PKG_HOME, including everything inside the
+	// directories it owns
+	Files []File `json:"files"`
 }
 
+// Reads the lockfile, falling back to the backup of the last successfully
+// written lockfile if it is truncated or corrupt
 func ReadLockfile() (Lockfile, error) {
-	data, err := os.ReadFile(LOCKFILE)
+	lf, err := readLockfile(LOCKFILE)
+	if err == nil {
+		return lf, nil
+	}
+	if _, statErr := os.Stat(LOCKFILE); os.IsNotExist(statErr) {
+		return nil, err
+	}
+
+	backup, backupErr := readLockfile(LOCKFILE_BACKUP)
+	if backupErr != nil {
+		return nil, fmt.Errorf("%vCould not recover from backup: %v", err, backupErr)
+	}
+
+	log.Errorf("%v", err)
+	log.Printf("Recovering lockfile from %s\n", LOCKFILE_BACKUP)
+	if err := WriteFileAtomic(LOCKFILE, mustEncode(backup)); err != nil {
+		return nil, fmt.Errorf("Error restoring lockfile: %v\n", err)
+	}
+
+	return backup, nil
+}
+
+func readLockfile(path string) (Lockfile, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("Error reading lockfile: %v\n", err)
 	}
 
-	lf := new(Lockfile)
-	if err := json.Unmarshal(data, lf); err != nil {
+	lf := Lockfile{}
+	if err := json.Unmarshal(data, &lf); err != nil {
 		return nil, fmt.Errorf("Error unmarshalling lockfile: %v\n", err)
 	}
+	if lf == nil {
+		lf = Lockfile{}
+	}
+
+	// lockfiles written before install reasons were recorded only list
+	// dependencies that weren't also installed explicitly
+	for name, entry := range lf {
+		if entry.Reason != "" {
+			continue
+		}
+		entry.Reason = ReasonExplicit
+		for _, other := range lf {
+			if slices.Contains(other.Dependencies, name) {
+				entry.Reason = ReasonDependency
+			}
+		}
+		lf[name] = entry
+	}
 
-	return *lf, nil
+	return lf, nil
 }
 
+// Atomically replaces the lockfile, keeping the previous lockfile as a backup
 func (lf Lockfile) Write() error {
-	f, err := os.Create(LOCKFILE)
-	if err != nil {
-		return fmt.Errorf("Error opening lockfile: %v\n", err)
+	// hard link the current lockfile to the backup, so that there's always a
+	// complete lockfile on disk, even if we crash in between these steps
+	if _, err := readLockfile(LOCKFILE); err == nil {
+		if err := os.Remove(LOCKFILE_BACKUP); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Error removing lockfile backup: %v\n", err)
+		}
+		if err := os.Link(LOCKFILE, LOCKFILE_BACKUP); err != nil {
+			return fmt.Errorf("Error backing up lockfile: %v\n", err)
+		}
 	}
-	defer f.Close()
 
-	if err := json.NewEncoder(f).Encode(lf); err != nil {
+	if err := WriteFileAtomic(LOCKFILE, mustEncode(lf)); err != nil {
 		return fmt.Errorf("Error writing to lockfile: %v\n", err)
 	}
 
@@ -46,3 +127,28 @@ func (lf Lockfile) Write() error {
 func (lf Lockfile) Remove(name string) {
 	delete(lf, name)
 }
+
+// Returns a deep copy of the lockfile
+func (lf Lockfile) Clone() Lockfile {
+	clone := make(Lockfile, len(lf))
+	for name, entry := range lf {
+		entry.Versions = slices.Clone(entry.Versions)
+		entry.Dependencies = slices.Clone(entry.Dependencies)
+		entry.Broken = slices.Clone(entry.Broken)
+		entry.Links = maps.Clone(entry.Links)
+		entry.Overwritten = maps.Clone(entry.Overwritten)
+		entry.Constraints = maps.Clone(entry.Constraints)
+		entry.Files = slices.Clone(entry.Files)
+		clone[name] = entry
+	}
+	return clone
+}
+
+func mustEncode(v any) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		// only maps and structs of strings are encoded, so this can't fail
+		panic(err)
+	}
+	return append(data, '\n')
+}
@@ -3,11 +3,22 @@ package log
 import (
 	"fmt"
 	"os"
+	"slices"
 )
 
+var exitHandlers []func()
+
+// Registers a function to be run before Fatalf exits
+func AtExit(fn func()) {
+	exitHandlers = append(exitHandlers, fn)
+}
+
 func Fatalf(format string, a ...any) {
 	fmt.Fprint(os.Stderr, "\033[31mERROR:\033[0m ")
 	fmt.Fprintf(os.Stderr, format, a...)
+	for _, fn := range slices.Backward(exitHandlers) {
+		fn()
+	}
 	os.Exit(1)
 }
 
@@ -1,6 +1,9 @@
 package manifest
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 type ErrorPackageNotFound struct {
 	Url string
@@ -18,3 +21,19 @@ type ErrorPackageUnsupported struct {
 func (e ErrorPackageUnsupported) Error() string {
 	return fmt.Sprintf("Package %s is not supported on this platform (%s)", e.Name, e.Platform)
 }
+
+type ErrorVersionNotFound struct {
+	Name, Version string
+	Available     []string
+}
+
+func (e ErrorVersionNotFound) Error() string {
+	if e.Available == nil {
+		return fmt.Sprintf("Version %s of %s not found, the manifest host does not publish older versions of %s", e.Version, e.Name, e.Name)
+	}
+	available := e.Available
+	if len(available) > 10 {
+		available = append(available[:10:10], fmt.Sprintf("and %d more", len(e.Available)-10))
+	}
+	return fmt.Sprintf("Version %s of %s not found, available versions: %s", e.Version, e.Name, strings.Join(available, ", "))
+}
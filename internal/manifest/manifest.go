@@ -1,15 +1,19 @@
 package manifest
 
 import (
+	"fmt"
+	"path/filepath"
 	"strings"
 
 	"github.com/pkg-mngr/pkg/internal/config"
 	"github.com/pkg-mngr/pkg/internal/util"
+	"github.com/pkg-mngr/pkg/internal/version"
 )
 
 const MANIFEST_EXT = ".json"
 
 type Manifest struct {
+	json         *ManifestJson
 	ManifestUrl  string
 	Name         string
 	Description  string
@@ -18,7 +22,10 @@ type Manifest struct {
 	Sha256       string
 	Url          string
 	Dependencies []string
+	Constraints  map[string]version.Constraints
 	Caveats      string
+	Extract      []Extract
+	Links        Links
 	Scripts      struct {
 		Install     []string
 		Latest      []string
@@ -37,6 +44,8 @@ type ManifestJson struct {
 	Url          map[Platform]string `json:"url"`
 	Dependencies []string            `json:"dependencies,omitempty"`
 	Caveats      string              `json:"caveats,omitempty"`
+	Extract      []Extract           `json:"extract,omitempty"`
+	Links        Links               `json:"links,omitzero"`
 	Scripts      struct {
 		Install     map[Platform][]string `json:"install"`
 		Latest      []string              `json:"latest"`
@@ -44,32 +53,106 @@ type ManifestJson struct {
 	} `json:"scripts"`
 }
 
+// A step extracting the downloaded archive, which runs before the install
+// script
+type Extract struct {
+	// Where to extract to, {{ pkg.opt_dir }} by default
+	To              string   `json:"to,omitempty"`
+	StripComponents int      `json:"strip_components,omitempty"`
+	Include         []string `json:"include,omitempty"`
+}
+
+// Files in the package's opt directory for pkg to link into PKG_HOME, as
+// patterns relative to the opt directory, such as go/bin/*
+type Links struct {
+	Bin            []string `json:"bin,omitempty"`
+	Man            []string `json:"man,omitempty"`
+	ZshCompletions []string `json:"zsh_completions,omitempty"`
+}
+
+// Gets the manifest for a package name or local manifest file, optionally
+// followed by `@version` to get a specific version
 func Get(pkgName string) (Manifest, error) {
-	if IsLocalFile(pkgName) {
-		manifestJson, err := FromFile(pkgName)
-		if err != nil {
-			return Manifest{}, err
-		}
-		return manifestJson.Process()
+	pkgName, pkgVersion := SplitVersion(pkgName)
+	url := pkgName
+	if !IsLocalFile(pkgName) {
+		url = getRemoteUrl(pkgName)
 	}
 
-	url := getRemoteUrl(pkgName)
-	manifestJson, err := FromRemote(url)
+	if pkgVersion != "" {
+		return GetVersion(url, pkgVersion)
+	}
+	return GetUrl(url)
+}
+
+// Gets the manifest from a manifest url or local file path, such as the ones
+// saved in the lockfile
+func GetUrl(url string) (Manifest, error) {
+	var manifestJson *ManifestJson
+	var err error
+	if IsLocalFile(url) {
+		manifestJson, err = FromFile(url)
+	} else {
+		manifestJson, err = FromRemote(url)
+	}
 	if err != nil {
 		return Manifest{}, err
 	}
 	return manifestJson.Process()
 }
 
+// The directories that the `pkg.*` template variables in a manifest are
+// replaced with
+type Dirs struct {
+	Bin, Opt, Tmp, ZshCompletions string
+}
+
+func DefaultDirs() Dirs {
+	return Dirs{
+		Bin:            config.PKG_BIN,
+		Opt:            config.PKG_OPT,
+		Tmp:            config.PKG_TMP,
+		ZshCompletions: config.PKG_ZSH_COMPLETIONS,
+	}
+}
+
+// Returns the directories for a prefix laid out like PKG_HOME at root, with
+// tmp as the temporary directory
+func DirsIn(root, tmp string) Dirs {
+	return Dirs{
+		Bin:            filepath.Join(root, "bin"),
+		Opt:            filepath.Join(root, "opt"),
+		Tmp:            tmp,
+		ZshCompletions: filepath.Join(root, "share/zsh/site-functions"),
+	}
+}
+
 func (manifestJson *ManifestJson) Process() (Manifest, error) {
+	return manifestJson.ProcessWith(DefaultDirs())
+}
+
+func (manifestJson *ManifestJson) ProcessWith(dirs Dirs) (Manifest, error) {
 	manifest := Manifest{
+		json:         manifestJson,
 		ManifestUrl:  manifestJson.ManifestUrl,
 		Name:         manifestJson.Name,
 		Description:  manifestJson.Description,
 		Homepage:     manifestJson.Homepage,
 		Version:      manifestJson.Version,
-		Caveats:      formatData(manifestJson.Caveats, *manifestJson),
-		Dependencies: manifestJson.Dependencies,
+		Caveats:      formatData(manifestJson.Caveats, *manifestJson, dirs),
+		Dependencies: []string{},
+		Constraints:  map[string]version.Constraints{},
+	}
+
+	for _, dep := range manifestJson.Dependencies {
+		name, constraints, err := ParseDependency(dep)
+		if err != nil {
+			return Manifest{}, fmt.Errorf("%s: Invalid dependency %q: %v", manifestJson.Name, dep, err)
+		}
+		manifest.Dependencies = append(manifest.Dependencies, name)
+		if len(constraints) > 0 {
+			manifest.Constraints[name] = constraints
+		}
 	}
 
 	// url, sha256, install script
@@ -77,38 +160,98 @@ func (manifestJson *ManifestJson) Process() (Manifest, error) {
 	sha256, sha256Ok := manifestJson.Sha256[PLATFORM]
 	installScript, installScriptOk := manifestJson.Scripts.Install[PLATFORM]
 
-	if !urlOk || !sha256Ok || !installScriptOk {
+	// extracting the archive can take the place of an install script
+	if !urlOk || !sha256Ok || (!installScriptOk && len(manifestJson.Extract) == 0) {
 		return Manifest{}, ErrorPackageUnsupported{Name: manifestJson.Name, Platform: PLATFORM}
 	}
 
-	manifest.Url = formatData(url, *manifestJson)
+	manifest.Url = formatData(url, *manifestJson, dirs)
 	manifest.Sha256 = sha256
 	manifest.Scripts.Install = util.Map(installScript, func(line string, i int) string {
-		return formatData(line, *manifestJson)
+		return formatData(line, *manifestJson, dirs)
 	})
 
+	for _, step := range manifestJson.Extract {
+		if step.To == "" {
+			step.To = "{{ pkg.opt_dir }}"
+		}
+		to := formatData(step.To, *manifestJson, dirs)
+		// relative paths would depend on the directory pkg runs in
+		if !filepath.IsAbs(to) {
+			return Manifest{}, fmt.Errorf("%s: Invalid extract destination %q: must be an absolute path, such as {{ pkg.opt_dir }}/%s", manifestJson.Name, step.To, manifestJson.Name)
+		}
+		manifest.Extract = append(manifest.Extract, Extract{
+			To:              to,
+			StripComponents: step.StripComponents,
+			Include: util.Map(step.Include, func(pattern string, i int) string {
+				return formatData(pattern, *manifestJson, dirs)
+			}),
+		})
+	}
+
+	format := func(patterns []string) []string {
+		return util.Map(patterns, func(pattern string, i int) string {
+			return formatData(pattern, *manifestJson, dirs)
+		})
+	}
+	manifest.Links = Links{
+		Bin:            format(manifestJson.Links.Bin),
+		Man:            format(manifestJson.Links.Man),
+		ZshCompletions: format(manifestJson.Links.ZshCompletions),
+	}
+
 	// latest script
 	latestScript := manifestJson.Scripts.Latest
 	manifest.Scripts.Latest = util.Map(latestScript, func(line string, i int) string {
-		return formatData(line, *manifestJson)
+		return formatData(line, *manifestJson, dirs)
 	})
 
 	// completions script
 	if completion, ok := manifestJson.Scripts.Completions[PLATFORM]; ok {
 		manifest.Scripts.Completions = util.Map(completion, func(line string, i int) string {
-			return formatData(line, *manifestJson)
+			return formatData(line, *manifestJson, dirs)
 		})
 	}
 
 	return manifest, nil
 }
 
-func formatData(val string, manifest ManifestJson) string {
+// Splits a dependency into the package name and its version constraints, for
+// example `node >= 20` or `go ~1.25`
+func ParseDependency(dep string) (string, version.Constraints, error) {
+	dep = strings.TrimSpace(dep)
+	i := strings.IndexAny(dep, " <>=!~^")
+	if i == -1 {
+		return dep, nil, nil
+	}
+	if i == 0 {
+		return "", nil, fmt.Errorf("Missing package name")
+	}
+
+	constraints, err := version.ParseConstraints(dep[i:])
+	if err != nil {
+		return "", nil, err
+	}
+	return dep[:i], constraints, nil
+}
+
+// Returns the manifest with its templates filled in using dirs instead of the
+// directories it was processed with
+func (manifest Manifest) WithDirs(dirs Dirs) Manifest {
+	if manifest.json == nil {
+		return manifest
+	}
+	// the manifest was already processed successfully, so this can't fail
+	processed, _ := manifest.json.ProcessWith(dirs)
+	return processed
+}
+
+func formatData(val string, manifest ManifestJson, dirs Dirs) string {
 	val = strings.ReplaceAll(val, "{{ version }}", manifest.Version)
-	val = strings.ReplaceAll(val, "{{ pkg.opt_dir }}", config.PKG_OPT)
-	val = strings.ReplaceAll(val, "{{ pkg.bin_dir }}", config.PKG_BIN)
-	val = strings.ReplaceAll(val, "{{ pkg.tmp_dir }}", config.PKG_TMP)
-	val = strings.ReplaceAll(val, "{{ pkg.completions.zsh }}", config.PKG_ZSH_COMPLETIONS)
+	val = strings.ReplaceAll(val, "{{ pkg.opt_dir }}", dirs.Opt)
+	val = strings.ReplaceAll(val, "{{ pkg.bin_dir }}", dirs.Bin)
+	val = strings.ReplaceAll(val, "{{ pkg.tmp_dir }}", dirs.Tmp)
+	val = strings.ReplaceAll(val, "{{ pkg.completions.zsh }}", dirs.ZshCompletions)
 
 	return val
 }
@@ -13,6 +13,9 @@ func FromFile(path string) (*ManifestJson, error) {
 	manifestJson.ManifestUrl = path
 
 	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrorPackageNotFound{Url: path}
+	}
 	if err != nil {
 		return nil, fmt.Errorf("Error reading data from %s: %v", path, err)
 	}
@@ -3,28 +3,60 @@ package manifest
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 
+	"github.com/pkg-mngr/pkg/internal/cache"
 	"github.com/pkg-mngr/pkg/internal/config"
+	"github.com/pkg-mngr/pkg/internal/log"
 )
 
 func FromRemote(url string) (*ManifestJson, error) {
 	manifestJson := new(ManifestJson)
 	manifestJson.ManifestUrl = url
 
-	res, err := http.Get(url)
-	if err != nil || res.StatusCode != http.StatusOK {
-		return nil, ErrorPackageNotFound{Url: url}
+	data, err := FetchRemote(url)
+	if err != nil {
+		return nil, err
 	}
-	defer res.Body.Close()
 
-	if err := json.NewDecoder(res.Body).Decode(manifestJson); err != nil {
+	if err := json.Unmarshal(data, manifestJson); err != nil {
 		return nil, fmt.Errorf("Error decoding data from manifest: %v", err)
 	}
 
 	return manifestJson, nil
 }
 
+// Fetches a file from a manifest host, caching it so that it can be read
+// offline. When offline, the file is read from the cache instead.
+func FetchRemote(url string) ([]byte, error) {
+	if config.OFFLINE {
+		return cache.GetMetadata(url)
+	}
+
+	res, err := http.Get(url)
+	if err != nil {
+		return nil, ErrorPackageNotFound{Url: url}
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, ErrorPackageNotFound{Url: url}
+	}
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s: %v", url, err)
+	}
+	if config.DRY_RUN {
+		return data, nil
+	}
+	// failing to cache only means it can't be read offline
+	if err := cache.PutMetadata(url, data); err != nil {
+		log.Errorf("%v", err)
+	}
+	return data, nil
+}
+
 func getRemoteUrl(pkgName string) string {
 	return fmt.Sprintf("%s/%s%s", config.MANIFEST_HOST, pkgName, MANIFEST_EXT)
 }
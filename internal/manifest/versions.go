@@ -0,0 +1,110 @@
+package manifest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/pkg-mngr/pkg/internal/version"
+)
+
+// Splits a package request such as `go@1.24.3` into the package and the
+// requested version. The version is empty if none was requested.
+func SplitVersion(pkg string) (string, string) {
+	i := strings.LastIndex(pkg, "@")
+	if i == -1 {
+		return pkg, ""
+	}
+	return pkg[:i], pkg[i+1:]
+}
+
+// Returns the url of the manifest for a specific version of the package whose
+// manifest is at url. For example, version 1.24.3 of
+// https://pkg.zerolimits.dev/go.json is at
+// https://pkg.zerolimits.dev/go/1.24.3.json.
+func VersionUrl(url, pkgVersion string) string {
+	return strings.TrimSuffix(url, MANIFEST_EXT) + "/" + pkgVersion + MANIFEST_EXT
+}
+
+// Returns the url of the list of versions published for the package whose
+// manifest is at url, e.g. https://pkg.zerolimits.dev/go/versions.json
+func VersionsUrl(url string) string {
+	return VersionUrl(url, "versions")
+}
+
+// Gets the versions published for the package whose manifest is at url,
+// newest first
+func Versions(url string) ([]string, error) {
+	versionsUrl := VersionsUrl(url)
+
+	var versions []string
+	if IsLocalFile(url) {
+		data, err := os.ReadFile(versionsUrl)
+		if err != nil {
+			return nil, ErrorPackageNotFound{Url: versionsUrl}
+		}
+		if err := json.Unmarshal(data, &versions); err != nil {
+			return nil, fmt.Errorf("Error unmarshalling data from %s: %v", versionsUrl, err)
+		}
+	} else {
+		data, err := FetchRemote(versionsUrl)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &versions); err != nil {
+			return nil, fmt.Errorf("Error decoding %s, expected a list of versions: %v", versionsUrl, err)
+		}
+	}
+
+	slices.SortFunc(versions, func(a, b string) int { return version.Compare(b, a) })
+	return versions, nil
+}
+
+// Gets the manifest for a specific version of the package whose manifest is
+// at url. The returned manifest's url is still the package's manifest url, so
+// that updates come from there.
+func GetVersion(url, pkgVersion string) (Manifest, error) {
+	pkgManifest, err := GetUrl(VersionUrl(url, pkgVersion))
+	if err != nil {
+		errPnf := ErrorPackageNotFound{}
+		if !errors.As(err, &errPnf) {
+			return Manifest{}, err
+		}
+
+		name := strings.TrimSuffix(path.Base(url), MANIFEST_EXT)
+		versions, versionsErr := Versions(url)
+		if versionsErr != nil {
+			return Manifest{}, ErrorVersionNotFound{Name: name, Version: pkgVersion}
+		}
+		return Manifest{}, ErrorVersionNotFound{Name: name, Version: pkgVersion, Available: versions}
+	}
+	if version.Compare(pkgManifest.Version, pkgVersion) != 0 {
+		return Manifest{}, fmt.Errorf("%s: Manifest at %s is for version %s, not %s",
+			pkgManifest.Name, VersionUrl(url, pkgVersion), pkgManifest.Version, pkgVersion)
+	}
+
+	pkgManifest.ManifestUrl = url
+	if pkgManifest.json != nil {
+		pkgManifest.json.ManifestUrl = url
+	}
+	return pkgManifest, nil
+}
+
+// Gets the manifest for the newest version of the package at url that
+// satisfies constraints, from the versions published by the manifest host
+func GetMatching(url string, constraints version.Constraints) (Manifest, error) {
+	versions, err := Versions(url)
+	if err != nil {
+		return Manifest{}, err
+	}
+	i := slices.IndexFunc(versions, constraints.Check)
+	if i == -1 {
+		name := strings.TrimSuffix(path.Base(url), MANIFEST_EXT)
+		return Manifest{}, ErrorVersionNotFound{Name: name, Version: constraints.String(), Available: versions}
+	}
+	return GetVersion(url, versions[i])
+}
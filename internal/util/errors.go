@@ -0,0 +1,25 @@
+package util
+
+import "fmt"
+
+type ErrorScriptCancelled struct{}
+
+func (e ErrorScriptCancelled) Error() string {
+	return "Script was not run, cancelled by user"
+}
+
+// A download that didn't match the checksum in its package's manifest
+type ErrorChecksumMismatch struct {
+	Name, Expected, Actual string
+	// Where the download was moved to, if it could be
+	Quarantined string
+}
+
+func (e ErrorChecksumMismatch) Error() string {
+	output := fmt.Sprintf("%s: Checksum of download did not match the package manifest\n  Expected: %s\n  Actual:   %s",
+		e.Name, e.Expected, e.Actual)
+	if e.Quarantined != "" {
+		output += fmt.Sprintf("\nThe download has been moved to %s for inspection", e.Quarantined)
+	}
+	return output
+}
@@ -1,15 +1,39 @@
 package util
 
 import (
-	"crypto/sha256"
+	"context"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/melbahja/got"
+	"github.com/pkg-mngr/pkg/internal/config"
+	"github.com/pkg-mngr/pkg/internal/log"
 )
 
-func Fetch(url, dest, name string) error {
-	g := got.New()
+// Downloads url to dest, printing its progress on one line. Returns the sha256
+// checksum of the download.
+func Fetch(ctx context.Context, url, dest, name string) (string, error) {
+	checksum, err := FetchWithProgress(ctx, url, dest, name, func(status string) {
+		fmt.Printf("\033[2K%s\r", status)
+	})
+	if err != nil {
+		return "", err
+	}
+	fmt.Println("\033[2KDownloaded 100%")
+	return checksum, nil
+}
+
+// Downloads url to dest like Fetch, passing its progress to report instead of
+// printing it, so that several downloads can show their progress at once
+func FetchWithProgress(ctx context.Context, url, dest, name string, report func(status string)) (string, error) {
+	if config.OFFLINE {
+		return "", fmt.Errorf("%s: Cannot download %s while offline", name, url)
+	}
+
+	g := got.NewWithContext(ctx)
 	g.ProgressFunc = func(d *got.Download) {
 		percent := float64(d.Size()) / float64(d.TotalSize()) * 100
 		speed := float64(d.AvgSpeed())
@@ -17,29 +41,63 @@ func Fetch(url, dest, name string) error {
 		if speed/1024/1024 >= 5 {
 			speedStr = fmt.Sprintf("%.2f MB/s", speed/1024/1024)
 		}
-		fmt.Printf("\033[2KDownloaded %.2f%% (%s)\r", percent, speedStr)
+		report(fmt.Sprintf("Downloaded %.2f%% (%s)", percent, speedStr))
 	}
 	if err := g.Download(url, dest); err != nil {
-		return fmt.Errorf("%s: Error while downloading %s: %v", name, dest, err)
+		return "", fmt.Errorf("%s: Error while downloading %s: %v", name, dest, err)
 	}
-	fmt.Println("\033[2KDownloaded 100%")
-	return nil
+
+	// got downloads in chunks, so the download can only be hashed once it's
+	// all there
+	checksum, err := config.HashFile(dest)
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", name, strings.TrimSpace(err.Error()))
+	}
+	return checksum, nil
 }
 
 // Returns an error if the sha256 checksum of the file does not match the
 // provided shasum, otherwise returns nil
 func VerifyChecksum(filename, shasum, name string) error {
-	data, err := os.ReadFile(filename)
+	fmt.Print("Verifying checksum...")
+	checksum, err := config.HashFile(filename)
 	if err != nil {
-		return fmt.Errorf("%s: Error reading data from response", name)
+		fmt.Println()
+		return fmt.Errorf("%s: %s", name, strings.TrimSpace(err.Error()))
 	}
-
-	fmt.Print("Verifying checksum...")
-	checksum := fmt.Sprintf("%x", sha256.Sum256(data))
-	if checksum != shasum {
-		return fmt.Errorf("\n%s: Checksum of data did not match in package manifest", name)
+	if err := CompareChecksum(filename, shasum, checksum, name); err != nil {
+		fmt.Println()
+		return err
 	}
 	fmt.Println(" Looks good!")
 
 	return nil
 }
+
+// Returns ErrorChecksumMismatch if checksum, the checksum of the file, does not
+// match the provided shasum, moving the file to the quarantine directory so
+// that it can be inspected
+func CompareChecksum(filename, shasum, checksum, name string) error {
+	if strings.EqualFold(checksum, shasum) {
+		return nil
+	}
+
+	mismatch := ErrorChecksumMismatch{Name: name, Expected: strings.ToLower(shasum), Actual: checksum}
+	if err := os.MkdirAll(filepath.Join(config.PKG_QUARANTINE, name), 0o755); err != nil {
+		log.Errorf("Error creating %s: %v\n", filepath.Join(config.PKG_QUARANTINE, name), err)
+		return mismatch
+	}
+	// the same download can be quarantined more than once a second
+	dir, err := os.MkdirTemp(filepath.Join(config.PKG_QUARANTINE, name), time.Now().Format("20060102-150405")+"-")
+	if err != nil {
+		log.Errorf("Error creating quarantine directory: %v\n", err)
+		return mismatch
+	}
+	quarantined := filepath.Join(dir, filepath.Base(filename))
+	if err := os.Rename(filename, quarantined); err != nil {
+		log.Errorf("Error moving %s to %s: %v\n", filename, quarantined, err)
+		return mismatch
+	}
+	mismatch.Quarantined = quarantined
+	return mismatch
+}
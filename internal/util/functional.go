@@ -1,5 +1,7 @@
 package util
 
+import "sync"
+
 func Map[T, U any](arr []T, mapFunc func(T, int) U) []U {
 	output := make([]U, len(arr))
 	for i, val := range arr {
@@ -7,3 +9,23 @@ func Map[T, U any](arr []T, mapFunc func(T, int) U) []U {
 	}
 	return output
 }
+
+// Like Map, but calls mapFunc from up to workers goroutines at once
+func ParallelMap[T, U any](arr []T, workers int, mapFunc func(T, int) U) []U {
+	output := make([]U, len(arr))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range min(max(workers, 1), len(arr)) {
+		wg.Go(func() {
+			for i := range jobs {
+				output[i] = mapFunc(arr[i], i)
+			}
+		})
+	}
+	for i := range arr {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return output
+}
@@ -0,0 +1,77 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// A line of progress for each of several tasks running at once. On a terminal
+// the lines are redrawn in place as they change, otherwise each line is only
+// printed once its task has finished, so that the output stays readable when
+// it's logged.
+type Progress struct {
+	mu       sync.Mutex
+	labels   []string
+	statuses []string
+	finished []bool
+	tty      bool
+	drawn    bool
+}
+
+func NewProgress(labels []string) *Progress {
+	width := 0
+	for _, label := range labels {
+		width = max(width, len(label))
+	}
+	p := &Progress{finished: make([]bool, len(labels))}
+	for _, label := range labels {
+		p.labels = append(p.labels, label+strings.Repeat(" ", width-len(label)))
+		p.statuses = append(p.statuses, "Waiting...")
+	}
+	if info, err := os.Stdout.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		p.tty = true
+	}
+	p.draw()
+	return p
+}
+
+// Updates the status of task i while it's running. Updates that arrive after
+// the task has finished are ignored.
+func (p *Progress) Update(i int, status string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.finished[i] {
+		return
+	}
+	p.statuses[i] = status
+	p.draw()
+}
+
+// Sets the final status of task i
+func (p *Progress) Finish(i int, status string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.statuses[i] = status
+	p.finished[i] = true
+	if !p.tty {
+		fmt.Printf("  %s  %s\n", p.labels[i], status)
+		return
+	}
+	p.draw()
+}
+
+func (p *Progress) draw() {
+	if !p.tty {
+		return
+	}
+	if p.drawn {
+		// move back up to the first line
+		fmt.Printf("\033[%dA", len(p.labels))
+	}
+	for i, label := range p.labels {
+		fmt.Printf("\033[2K  \033[1m%s\033[0m  %s\n", label, p.statuses[i])
+	}
+	p.drawn = true
+}
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
@@ -11,23 +12,37 @@ import (
 )
 
 func RunScript(script string, skipConfirmation bool) (string, error) {
+	return RunScriptIn(context.Background(), script, config.PKG_TMP, nil, skipConfirmation)
+}
+
+// Runs the script from dir, with env added to the environment. The script is
+// killed if ctx is cancelled.
+func RunScriptIn(ctx context.Context, script, dir string, env []string, skipConfirmation bool) (string, error) {
 	if !skipConfirmation && !getConfirmation(script) {
-		return "", nil
+		return "", ErrorScriptCancelled{}
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
 	}
 	shell := os.Getenv("SHELL")
 	if shell == "" {
 		shell = "/bin/bash"
 	}
 
-	script = fmt.Sprintf("set -euo pipefail\ncd %s\n%s", config.PKG_TMP, script)
-	cmd := exec.Command(shell, "-c", script)
+	script = fmt.Sprintf("set -euo pipefail\ncd %s\n%s", dir, script)
+	cmd := exec.CommandContext(ctx, shell, "-c", script)
+	cmd.Env = append(os.Environ(), env...)
 
 	var stdout, stderr strings.Builder
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
 	if err := cmd.Run(); err != nil {
-		log.Errorf("Error running command: %v", err)
+		log.Errorf("Error running command: %v\n", err)
+		// scripts that fail without saying why still need a reason to report
+		if strings.TrimSpace(stderr.String()) == "" {
+			return stdout.String(), fmt.Errorf("Script failed: %v", err)
+		}
 		return stdout.String(), fmt.Errorf("%s", stderr.String())
 	}
 
@@ -39,8 +54,14 @@ func getConfirmation(script string) bool {
 	for line := range strings.Lines(script) {
 		fmt.Printf("  %s", SyntaxHighlight(line))
 	}
+	fmt.Println()
+	return Confirm("Proceed?")
+}
+
+// Asks the user a yes or no question, defaulting to no
+func Confirm(question string) bool {
 	confirmation := "N"
-	fmt.Print("\nProceed? [y/N]: ")
+	fmt.Printf("%s [y/N]: ", question)
 	fmt.Scanln(&confirmation)
 
 	return strings.ToLower(confirmation) == "y"
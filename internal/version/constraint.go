@@ -0,0 +1,121 @@
+package version
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A single requirement on a version, such as `>= 20`
+type Constraint struct {
+	Op      string
+	Version string
+}
+
+// A set of requirements that a version must satisfy all of
+type Constraints []Constraint
+
+// Operators, longest first so that `>=` isn't parsed as `>`
+var operators = []string{"==", "!=", ">=", "<=", "=", ">", "<", "~", "^"}
+
+// Parses comma separated constraints, such as `>= 20, < 22`. `~1.25` allows
+// any 1.25.x version and `^1.2` allows any 1.x version from 1.2 onwards. A
+// version without an operator must match exactly.
+func ParseConstraints(s string) (Constraints, error) {
+	constraints := Constraints{}
+	for part := range strings.SplitSeq(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			return nil, ErrorInvalidConstraint{Constraint: s}
+		}
+
+		op := "="
+		if i := slices.IndexFunc(operators, func(op string) bool { return strings.HasPrefix(part, op) }); i != -1 {
+			op = operators[i]
+			part = strings.TrimSpace(part[len(op):])
+		}
+		if op == "==" {
+			op = "="
+		}
+		if part == "" || strings.ContainsAny(part, " <>=!~^") {
+			return nil, ErrorInvalidConstraint{Constraint: s}
+		}
+		if (op == "~" || op == "^") && len(Parse(part).Release) == 0 {
+			return nil, ErrorInvalidConstraint{Constraint: s}
+		}
+
+		constraints = append(constraints, Constraint{Op: op, Version: part})
+	}
+
+	return constraints, nil
+}
+
+// Returns true if v satisfies every constraint
+func (cs Constraints) Check(v string) bool {
+	for _, c := range cs {
+		if !c.Check(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c Constraint) Check(v string) bool {
+	cmp := Compare(v, c.Version)
+	switch c.Op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case "~", "^":
+		return cmp >= 0 && Compare(v, c.upperBound()) < 0
+	}
+	return false
+}
+
+// Returns the first version not allowed by a `~` or `^` constraint
+func (c Constraint) upperBound() string {
+	parts := Parse(c.Version).Release
+
+	// ~1.25.1 and ~1.25 allow 1.25.x, ~1 allows 1.x
+	bump := min(1, len(parts)-1)
+	if c.Op == "^" {
+		// ^1.2.3 allows 1.x, ^0.2.3 allows 0.2.x, ^0.0.3 only allows 0.0.3
+		bump = 0
+		for bump < len(parts)-1 && parts[bump] == 0 {
+			bump++
+		}
+	}
+
+	bound := make([]string, bump+1)
+	for i, part := range parts[:bump+1] {
+		if i == bump {
+			part++
+		}
+		bound[i] = strconv.Itoa(part)
+	}
+	return strings.Join(bound, ".")
+}
+
+func (cs Constraints) String() string {
+	parts := make([]string, len(cs))
+	for i, c := range cs {
+		parts[i] = c.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (c Constraint) String() string {
+	if c.Op == "~" || c.Op == "^" {
+		return c.Op + c.Version
+	}
+	return c.Op + " " + c.Version
+}
@@ -0,0 +1,11 @@
+package version
+
+import "fmt"
+
+type ErrorInvalidConstraint struct {
+	Constraint string
+}
+
+func (e ErrorInvalidConstraint) Error() string {
+	return fmt.Sprintf("Invalid version constraint: %s", e.Constraint)
+}
@@ -0,0 +1,154 @@
+package version
+
+import (
+	"cmp"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A version in any of the schemes packages use: semver, MAJOR.MINOR.PATCH with
+// optional -prerelease and +build parts; calendar versions starting with a
+// date, such as 2024.10.01 or 2024-10-01; or anything else, compared as dotted
+// numbers, e.g. 1.2 or 1.2.3.4
+type Version struct {
+	Raw string
+	// The numeric parts of the version, e.g. [1 25 1] for 1.25.1
+	Release []int
+	// Identifiers after the release, e.g. [rc 1] for 1.25.0-rc.1. A version
+	// with a prerelease is older than the same version without one.
+	Prerelease []string
+}
+
+var datePattern = regexp.MustCompile(`^(\d{4})-(\d{2})-(\d{2})`)
+
+// Parses a version. Parsing never fails, since every string is at least a
+// loose version, however unusual.
+func Parse(raw string) Version {
+	v := Version{Raw: raw, Release: []int{}, Prerelease: []string{}}
+
+	s := strings.TrimSpace(raw)
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "v"), "V")
+	// build metadata doesn't affect ordering
+	s, _, _ = strings.Cut(s, "+")
+
+	// dashes in dates separate the release, not a prerelease
+	s = datePattern.ReplaceAllString(s, "$1.$2.$3")
+
+	release, prerelease, _ := strings.Cut(s, "-")
+	for segment := range strings.SplitSeq(release, ".") {
+		// a segment with a non-numeric suffix, such as the 0rc1 in 1.0rc1, ends
+		// the release and starts the prerelease
+		digits := len(segment) - len(strings.TrimLeft(segment, "0123456789"))
+		if digits == 0 {
+			prerelease = joinNonEmpty(".", segment, prerelease)
+			break
+		}
+		n, _ := strconv.Atoi(segment[:digits])
+		v.Release = append(v.Release, n)
+		if digits < len(segment) {
+			prerelease = joinNonEmpty(".", segment[digits:], prerelease)
+			break
+		}
+	}
+	if prerelease != "" {
+		v.Prerelease = strings.FieldsFunc(prerelease, func(r rune) bool { return r == '.' || r == '-' || r == '_' })
+	}
+
+	return v
+}
+
+func joinNonEmpty(sep string, parts ...string) string {
+	return strings.Join(slices.DeleteFunc(parts, func(s string) bool { return s == "" }), sep)
+}
+
+// Compares two versions, returning -1 if a is older than b, 1 if a is newer
+// than b, and 0 if they're the same version
+func Compare(a, b string) int {
+	return Parse(a).Compare(Parse(b))
+}
+
+func (v Version) Compare(other Version) int {
+	// missing segments count as 0, so 1.25 is the same as 1.25.0
+	for i := range max(len(v.Release), len(other.Release)) {
+		x, y := 0, 0
+		if i < len(v.Release) {
+			x = v.Release[i]
+		}
+		if i < len(other.Release) {
+			y = other.Release[i]
+		}
+		if c := cmp.Compare(x, y); c != 0 {
+			return c
+		}
+	}
+
+	// a prerelease comes before its release
+	switch {
+	case len(v.Prerelease) == 0 && len(other.Prerelease) == 0:
+		return 0
+	case len(v.Prerelease) == 0:
+		return 1
+	case len(other.Prerelease) == 0:
+		return -1
+	}
+
+	for i := range min(len(v.Prerelease), len(other.Prerelease)) {
+		if c := compareIdentifier(v.Prerelease[i], other.Prerelease[i]); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(v.Prerelease), len(other.Prerelease))
+}
+
+// Numeric identifiers are compared numerically and come before alphanumeric
+// ones, which are compared lexically
+func compareIdentifier(a, b string) int {
+	x, xErr := strconv.Atoi(a)
+	y, yErr := strconv.Atoi(b)
+	switch {
+	case xErr == nil && yErr == nil:
+		return cmp.Compare(x, y)
+	case xErr == nil:
+		return -1
+	case yErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// The direction of a change from one version to another
+type Direction int
+
+const (
+	Downgrade Direction = iota - 1
+	Same
+	Upgrade
+)
+
+func Diff(from, to string) Direction {
+	return Direction(Compare(to, from))
+}
+
+func (d Direction) String() string {
+	switch d {
+	case Upgrade:
+		return "upgrade"
+	case Downgrade:
+		return "downgrade"
+	}
+	return "same"
+}
+
+// Returns an arrow showing the direction of the change, coloured green for
+// upgrades and red for downgrades
+func (d Direction) Arrow() string {
+	switch d {
+	case Upgrade:
+		return "\033[32m↑\033[0m"
+	case Downgrade:
+		return "\033[31m↓\033[0m"
+	}
+	return "="
+}
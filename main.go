@@ -1,10 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"maps"
+	"os"
 	"slices"
+	"strings"
+	"time"
 
 	"github.com/noclaps/applause"
 	"github.com/pkg-mngr/pkg/internal/cmd"
@@ -15,23 +19,94 @@ import (
 
 type Args struct {
 	Add struct {
-		Packages []string `help:"Packages to install"`
-		Yes      bool     `type:"option" short:"y" help:"Skip confirmation to run scripts"`
+		Packages  []string `help:"Packages to install"`
+		Yes       bool     `type:"option" short:"y" help:"Skip confirmation to run scripts"`
+		Offline   bool     `type:"option" help:"Install from cached manifests and downloads without accessing the network"`
+		Overwrite bool     `type:"option" help:"Take over files that belong to other packages"`
+		DryRun    bool     `type:"option" help:"Show what would be downloaded, run and changed without changing anything"`
+		Jobs      int      `type:"option" value:"n" help:"How many manifests and downloads to fetch at once, 4 by default or PKG_JOBS"`
+		Wait      int      `type:"option" value:"seconds" help:"Seconds to wait for another pkg process to finish, 0 waits forever"`
 	} `help:"Install packages"`
 	Update *struct {
-		Packages []string `help:"Packages to update" completion:"$(jq -r 'keys[]' $PKG_HOME/pkg.lock | tr '\n' ' ')"`
-		Yes      bool     `type:"option" short:"y" help:"Skip confirmation to run scripts"`
+		Packages       []string `help:"Packages to update" completion:"$(jq -r 'keys[]' $PKG_HOME/pkg.lock | tr '\n' ' ')"`
+		Yes            bool     `type:"option" short:"y" help:"Skip confirmation to run scripts"`
+		AllowDowngrade bool     `type:"option" help:"Update to the available version even if it's older than the installed one"`
+		Offline        bool     `type:"option" help:"Update from cached manifests and downloads without accessing the network"`
+		Overwrite      bool     `type:"option" help:"Take over files that belong to other packages"`
+		DryRun         bool     `type:"option" help:"Show what would be downloaded, run and changed without changing anything"`
+		Jobs           int      `type:"option" value:"n" help:"How many manifests and downloads to fetch at once, 4 by default or PKG_JOBS"`
+		Wait           int      `type:"option" value:"seconds" help:"Seconds to wait for another pkg process to finish, 0 waits forever"`
 	} `help:"Update packages"`
 	Remove struct {
 		Packages []string `help:"Packages to remove" completion:"$(jq -r 'keys[]' $PKG_HOME/pkg.lock | tr '\n' ' ')"`
-	} `help:"Remove packages"`
+		Cascade  bool     `type:"option" help:"Also remove the packages that depend on them"`
+		Force    bool     `type:"option" help:"Remove them even if other packages depend on them, marking those as broken"`
+		Yes      bool     `type:"option" short:"y" help:"Skip confirmation to remove dependent packages"`
+		DryRun   bool     `type:"option" help:"Show the files that would be deleted without changing anything"`
+		Wait     int      `type:"option" value:"seconds" help:"Seconds to wait for another pkg process to finish, 0 waits forever"`
+	} `help:"Remove packages, or one of several installed versions with name@version"`
+	Switch struct {
+		Package string `help:"The package to switch versions of" completion:"$(jq -r 'keys[]' $PKG_HOME/pkg.lock | tr '\n' ' ')"`
+		Version string `help:"The installed version to switch to"`
+		Wait    int    `type:"option" value:"seconds" help:"Seconds to wait for another pkg process to finish, 0 waits forever"`
+	} `help:"Switch the active version of a package"`
+	Pin struct {
+		Package []string `help:"The package to pin, optionally followed by a version constraint such as ~1.25, to allow updates within it" completion:"$(jq -r 'keys[]' $PKG_HOME/pkg.lock | tr '\n' ' ')"`
+		Wait    int      `type:"option" value:"seconds" help:"Seconds to wait for another pkg process to finish, 0 waits forever"`
+	} `help:"Hold a package at its installed version, or within a version constraint, during updates"`
+	Unpin struct {
+		Package string `help:"The package to unpin" completion:"$(jq -r 'keys[]' $PKG_HOME/pkg.lock | tr '\n' ' ')"`
+		Wait    int    `type:"option" value:"seconds" help:"Seconds to wait for another pkg process to finish, 0 waits forever"`
+	} `help:"Allow a pinned package to be updated again"`
+	Mark struct {
+		Packages   []string `help:"Packages to mark" completion:"$(jq -r 'keys[]' $PKG_HOME/pkg.lock | tr '\n' ' ')"`
+		Explicit   bool     `type:"option" help:"Mark the packages as installed explicitly, so that autoremove keeps them"`
+		Dependency bool     `type:"option" help:"Mark the packages as installed as dependencies, so that autoremove removes them once nothing needs them"`
+		Wait       int      `type:"option" value:"seconds" help:"Seconds to wait for another pkg process to finish, 0 waits forever"`
+	} `help:"Mark packages as installed explicitly or as dependencies"`
+	Autoremove *struct {
+		Wait int `type:"option" value:"seconds" help:"Seconds to wait for another pkg process to finish, 0 waits forever"`
+	} `help:"Remove packages installed as dependencies that nothing needs any more"`
+	Verify *struct {
+		Packages []string `help:"Packages to verify, every installed package by default" completion:"$(jq -r 'keys[]' $PKG_HOME/pkg.lock | tr '\n' ' ')"`
+		Repair   bool     `type:"option" help:"Reinstall the packages with problems, verifying their downloads again"`
+		Yes      bool     `type:"option" short:"y" help:"Skip confirmation to run scripts when repairing"`
+		Wait     int      `type:"option" value:"seconds" help:"Seconds to wait for another pkg process to finish, 0 waits forever"`
+	} `help:"Check installed files for changes since they were installed"`
+	Doctor *struct {
+		Fix  bool `type:"option" help:"Fix the problems that can be fixed safely"`
+		Wait int  `type:"option" value:"seconds" help:"Seconds to wait for another pkg process to finish, 0 waits forever"`
+	} `help:"Check your setup and PKG_HOME for problems"`
+	Cache struct {
+		List  bool `type:"command" help:"List cached downloads"`
+		Clean *struct {
+			Wait int `type:"option" value:"seconds" help:"Seconds to wait for another pkg process to finish, 0 waits forever"`
+		} `help:"Remove every cached download"`
+		Prune *struct {
+			OlderThan string `type:"option" value:"age" help:"Remove downloads that haven't been used for longer than this, such as 30d or 12h"`
+			Wait      int    `type:"option" value:"seconds" help:"Seconds to wait for another pkg process to finish, 0 waits forever"`
+		} `help:"Remove cached downloads that haven't been used recently"`
+	} `help:"Manage the download cache"`
 	Info struct {
 		Package string `help:"The package to get the info for"`
+		Offline bool   `type:"option" help:"Use cached manifests without accessing the network"`
 	} `help:"Get the info for a package"`
 	Search struct {
-		Name string `help:"The search query"`
+		Name    string `help:"The search query"`
+		Offline bool   `type:"option" help:"Search the cached package index without accessing the network"`
 	} `help:"Search for packages"`
-	List bool `type:"command" help:"List installed packages"`
+	Outdated *struct {
+		Json    bool `type:"option" help:"Output JSON"`
+		Offline bool `type:"option" help:"Check against cached manifests without accessing the network"`
+	} `help:"List installed packages that have updates, exiting with an error if any do"`
+	Why struct {
+		Package string `help:"The package to explain" completion:"$(jq -r 'keys[]' $PKG_HOME/pkg.lock | tr '\n' ' ')"`
+		Json    bool   `type:"option" help:"Output JSON"`
+	} `help:"Show the chains of dependents that a package is installed for"`
+	List *struct {
+		Tree bool `type:"option" help:"Show the dependencies of installed packages as a tree"`
+		Json bool `type:"option" help:"Output JSON"`
+	} `help:"List installed packages"`
 	Init bool `type:"option" help:"Initialise pkg"`
 }
 
@@ -41,16 +116,34 @@ func main() {
 		log.Fatalf("%v\n", err)
 	}
 
+	// offline mode can also be turned on with PKG_OFFLINE=1
+	if args.Add.Offline || (args.Update != nil && args.Update.Offline) || (args.Outdated != nil && args.Outdated.Offline) ||
+		args.Info.Offline || args.Search.Offline {
+		config.OFFLINE = true
+	}
+	if args.Add.DryRun || (args.Update != nil && args.Update.DryRun) || args.Remove.DryRun {
+		config.DRY_RUN = true
+	}
+	// the number of jobs can also be set with PKG_JOBS
+	if args.Add.Jobs > 0 {
+		config.JOBS = args.Add.Jobs
+	} else if args.Update != nil && args.Update.Jobs > 0 {
+		config.JOBS = args.Update.Jobs
+	}
+
 	if args.Info.Package != "" {
 		info, err := cmd.Info(args.Info.Package)
 		if err != nil {
 			errPnf := manifest.ErrorPackageNotFound{}
 			errPu := manifest.ErrorPackageUnsupported{}
+			errVnf := manifest.ErrorVersionNotFound{}
 			switch {
 			case errors.As(err, &errPnf):
 				log.Errorf("%v\n", errPnf)
 			case errors.As(err, &errPu):
 				log.Errorf("%v\n", errPu)
+			case errors.As(err, &errVnf):
+				log.Errorf("%v\n", errVnf)
 			default:
 				log.Fatalf("%v\n", err)
 			}
@@ -85,62 +178,373 @@ func main() {
 		return
 	}
 
+	if args.Cache.List {
+		entries, err := cmd.CacheList()
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		if len(entries) == 0 {
+			fmt.Println("No cached downloads!")
+			return
+		}
+
+		fmt.Println("\n\033[32;1m===\033[0;1m Cached downloads\033[0m")
+		for _, entry := range entries {
+			fmt.Println(entry)
+		}
+		fmt.Println()
+		return
+	}
+
+	if args.Cache.Prune != nil && args.Cache.Prune.OlderThan == "" {
+		log.Fatalf("Use --older-than to choose which downloads to remove, such as --older-than 30d\n")
+	}
+
+	// commands that make changes to PKG_HOME hold the lock until they exit, while
+	// read-only commands and dry runs can run alongside them
+	wait, locking := 0, true
+	switch {
+	case len(args.Add.Packages) != 0 && !args.Add.DryRun:
+		wait = args.Add.Wait
+	case args.Update != nil && !args.Update.DryRun:
+		wait = args.Update.Wait
+	case len(args.Remove.Packages) != 0 && !args.Remove.DryRun:
+		wait = args.Remove.Wait
+	case args.Switch.Package != "":
+		wait = args.Switch.Wait
+	case len(args.Pin.Package) != 0:
+		wait = args.Pin.Wait
+	case args.Unpin.Package != "":
+		wait = args.Unpin.Wait
+	case len(args.Mark.Packages) != 0:
+		wait = args.Mark.Wait
+	case args.Autoremove != nil:
+		wait = args.Autoremove.Wait
+	case args.Verify != nil && args.Verify.Repair:
+		wait = args.Verify.Wait
+	case args.Doctor != nil && args.Doctor.Fix:
+		wait = args.Doctor.Wait
+	case args.Cache.Clean != nil:
+		wait = args.Cache.Clean.Wait
+	case args.Cache.Prune != nil:
+		wait = args.Cache.Prune.Wait
+	default:
+		locking = false
+	}
+	if wait < 0 {
+		log.Fatalf("--wait must be 0 or more seconds\n")
+	}
+	if locking {
+		unlock, err := config.Lock(time.Duration(wait) * time.Second)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		defer unlock()
+
+		// finish or undo anything a previous run left unfinished before making
+		// any more changes. The doctor does it itself, so that it can report it.
+		if args.Doctor == nil {
+			if err := config.RecoverJournal(); err != nil {
+				log.Fatalf("%v\n", err)
+			}
+		}
+	}
+
+	// the cache isn't tracked in the lockfile
+	if args.Cache.Clean != nil {
+		if err := cmd.CacheClean(); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		return
+	}
+	if args.Cache.Prune != nil {
+		if err := cmd.CachePrune(args.Cache.Prune.OlderThan); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		return
+	}
+
+	// the doctor reads the lockfile itself, as it may be what's broken
+	if args.Doctor != nil {
+		checks, err := cmd.Doctor(args.Doctor.Fix)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+
+		fmt.Println("\n\033[32;1m===\033[0;1m Doctor\033[0m")
+		problems := 0
+		for _, check := range checks {
+			fmt.Println(check)
+			if len(check.Problems) > 0 && !check.Fixed {
+				problems++
+			}
+		}
+		fmt.Println()
+		if problems > 0 {
+			log.Fatalf("%d checks found problems\n", problems)
+		}
+		return
+	}
+
 	lockfile, err := config.ReadLockfile()
 	if err != nil {
 		log.Fatalf("%v\n", err)
 	}
-	defer lockfile.Write()
 
 	if len(args.Add.Packages) != 0 {
-		for _, pkg := range args.Add.Packages {
-			if err := cmd.Add(pkg, args.Add.Yes, lockfile); err != nil {
-				errPnf := manifest.ErrorPackageNotFound{}
-				errPu := manifest.ErrorPackageUnsupported{}
-				switch {
-				case errors.As(err, &errPnf):
-					log.Errorf("%v\n", errPnf)
-				case errors.As(err, &errPu):
-					log.Errorf("%v\n", errPu)
-				default:
-					log.Fatalf("%v\n", err)
-				}
-				continue
+		if err := cmd.Add(args.Add.Packages, args.Add.Yes, args.Add.Overwrite, args.Add.DryRun, lockfile); err != nil {
+			errSkipped := cmd.ErrorPackagesSkipped{}
+			if !errors.As(err, &errSkipped) {
+				log.Fatalf("%v\n", err)
+			}
+			for _, err := range errSkipped.Errs {
+				log.Errorf("%v\n", err)
 			}
 		}
 		return
 	}
 
 	if args.Update != nil {
-		pkgs := slices.Collect(maps.Keys(lockfile))
+		pkgs := slices.Sorted(maps.Keys(lockfile))
 		if len(args.Update.Packages) > 0 {
 			pkgs = args.Update.Packages
 		}
-		if err := cmd.Update(pkgs, args.Update.Yes, lockfile); err != nil {
-			errPnf := manifest.ErrorPackageNotFound{}
-			errPu := manifest.ErrorPackageUnsupported{}
-			switch {
-			case errors.As(err, &errPnf):
-				log.Errorf("%v\n", errPnf)
-			case errors.As(err, &errPu):
-				log.Errorf("%v\n", errPu)
-			default:
-				log.Fatalf("%v\n", err)
-			}
+		results, err := cmd.Update(pkgs, args.Update.Yes, args.Update.AllowDowngrade, args.Update.Overwrite, args.Update.DryRun, lockfile)
+		if err != nil && results == nil {
+			log.Fatalf("%v\n", err)
+		}
+
+		if !slices.ContainsFunc(results, func(result cmd.UpdateResult) bool {
+			return result.Status != cmd.UpdateCurrent || result.Reason != ""
+		}) {
+			fmt.Println("All packages are up to date")
 			return
 		}
+		title := "Update summary"
+		if args.Update.DryRun {
+			title += " (dry run)"
+		}
+		fmt.Printf("\n\033[32;1m===\033[0;1m %s\033[0m\n", title)
+		for _, line := range cmd.UpdateTable(results) {
+			fmt.Println(line)
+		}
+		fmt.Println()
+		// an interrupted update still shows what it managed to do
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+
+		failed := 0
+		for _, result := range results {
+			if result.Status == cmd.UpdateFailed {
+				failed++
+			}
+		}
+		if failed > 0 {
+			log.Fatalf("%d packages failed to update\n", failed)
+		}
 		return
 	}
 
 	if len(args.Remove.Packages) != 0 {
-		for _, pkg := range args.Remove.Packages {
-			if err := cmd.Remove(pkg, lockfile, false); err != nil {
-				log.Fatalf("%v\n", err)
+		if args.Remove.Cascade && args.Remove.Force {
+			log.Fatalf("Use either --cascade or --force\n")
+		}
+		if err := cmd.Remove(args.Remove.Packages, args.Remove.Cascade, args.Remove.Force, args.Remove.Yes, args.Remove.DryRun, lockfile); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		if args.Remove.DryRun {
+			return
+		}
+		if err := lockfile.Write(); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		return
+	}
+
+	if args.Switch.Package != "" {
+		if err := cmd.Switch(args.Switch.Package, args.Switch.Version, lockfile); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		return
+	}
+
+	if len(args.Pin.Package) != 0 {
+		// constraints with spaces, such as `>= 20`, may be given unquoted
+		constraint := strings.Join(args.Pin.Package[1:], " ")
+		if err := cmd.Pin(args.Pin.Package[0], constraint, lockfile); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		if err := lockfile.Write(); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		return
+	}
+
+	if args.Unpin.Package != "" {
+		if err := cmd.Unpin(args.Unpin.Package, lockfile); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		if err := lockfile.Write(); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		return
+	}
+
+	if len(args.Mark.Packages) != 0 {
+		if args.Mark.Explicit == args.Mark.Dependency {
+			log.Fatalf("Use either --explicit or --dependency\n")
+		}
+		reason := config.ReasonExplicit
+		if args.Mark.Dependency {
+			reason = config.ReasonDependency
+		}
+		if err := cmd.Mark(args.Mark.Packages, reason, lockfile); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		if err := lockfile.Write(); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		return
+	}
+
+	if args.Autoremove != nil {
+		removed, err := cmd.Autoremove(lockfile)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		if err := lockfile.Write(); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		if len(removed) == 0 {
+			fmt.Println("No packages to remove!")
+		}
+		return
+	}
+
+	if args.Verify != nil {
+		pkgs := slices.Sorted(maps.Keys(lockfile))
+		if len(args.Verify.Packages) > 0 {
+			pkgs = args.Verify.Packages
+		}
+		problems, err := cmd.Verify(pkgs, lockfile)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		if len(problems) == 0 {
+			fmt.Printf("Verified %d packages, no problems found\n", len(pkgs))
+			return
+		}
+
+		fmt.Println("\n\033[31;1m===\033[0;1m Problems found\033[0m")
+		for _, pkg := range slices.Sorted(maps.Keys(problems)) {
+			fmt.Printf("\033[1m%s:\033[0m\n", pkg)
+			for _, problem := range problems[pkg] {
+				fmt.Printf("  %s\n", problem)
 			}
 		}
+		fmt.Println()
+		if !args.Verify.Repair {
+			failed := strings.Join(slices.Sorted(maps.Keys(problems)), " ")
+			log.Fatalf("%d of %d packages failed verification, reinstall them with `pkg verify --repair %s`\n", len(problems), len(pkgs), failed)
+		}
+
+		if err := cmd.Repair(problems, args.Verify.Yes, lockfile); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		problems, err = cmd.Verify(slices.Sorted(maps.Keys(problems)), lockfile)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		if len(problems) > 0 {
+			log.Fatalf("%d packages still failed verification after repairing them\n", len(problems))
+		}
+		fmt.Println("Repaired every package")
 		return
 	}
 
-	if args.List {
+	if args.Outdated != nil {
+		pkgs := cmd.Outdated(lockfile)
+		outdated, failed := 0, 0
+		for _, pkg := range pkgs {
+			if pkg.Outdated() {
+				outdated++
+			}
+			if pkg.Error != "" {
+				failed++
+			}
+		}
+
+		if args.Outdated.Json {
+			printJson(pkgs)
+		} else {
+			for _, pkg := range pkgs {
+				if pkg.Error != "" {
+					log.Errorf("Error checking %s for updates: %s\n", pkg.Name, pkg.Error)
+				}
+			}
+			if table := cmd.OutdatedTable(pkgs); len(table) > 1 {
+				fmt.Println("\n\033[32;1m===\033[0;1m Outdated\033[0m")
+				for _, line := range table {
+					fmt.Println(line)
+				}
+				fmt.Println()
+			}
+			if outdated == 0 && failed == 0 {
+				fmt.Println("All packages are up to date")
+			}
+		}
+
+		// for CI to fail when packages are out of date, or to tell that they
+		// couldn't all be checked
+		if failed > 0 {
+			os.Exit(2)
+		}
+		if outdated > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if args.Why.Package != "" {
+		why, err := cmd.Why(args.Why.Package, lockfile)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		if args.Why.Json {
+			printJson(why)
+			return
+		}
+		fmt.Printf("\n\033[32;1m===\033[0;1m Why %s is installed\033[0m\n", why.Package)
+		fmt.Println(why)
+		fmt.Println()
+		return
+	}
+
+	if args.List != nil && args.List.Tree {
+		tree := cmd.ListTree(lockfile)
+		if args.List.Json {
+			printJson(tree)
+			return
+		}
+		if len(tree) == 0 {
+			fmt.Println("No packages installed!")
+			return
+		}
+
+		fmt.Println("\n\033[32;1m===\033[0;1m Installed\033[0m")
+		for _, line := range cmd.RenderTree(tree) {
+			fmt.Println(line)
+		}
+		fmt.Println()
+		return
+	}
+
+	if args.List != nil {
+		if args.List.Json {
+			printJson(cmd.ListFlat(lockfile))
+			return
+		}
 		pkgs := cmd.List(lockfile)
 		if len(pkgs) == 0 {
 			fmt.Println("No packages installed!")
@@ -155,3 +559,11 @@ func main() {
 		return
 	}
 }
+
+func printJson(v any) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Fatalf("Error encoding JSON: %v\n", err)
+	}
+	fmt.Println(string(data))
+}
@@ -13,8 +13,9 @@ type Manifest = {
   url: Record<string, string>;
   dependencies: string[];
   caveats?: string;
+  extract?: { to?: string; strip_components?: number; include?: string[] }[];
   scripts: {
-    install: Record<string, string[]>;
+    install?: Record<string, string[]>;
     latest: string[];
     completions?: Record<string, string[]>;
   };
@@ -42,15 +43,18 @@ const index = indexTemplate.replace(
 );
 Bun.write("./packages/index.md", index);
 
+// each version is installed into its own prefix, which pkg then links into
+// $PKG_HOME/bin and the completions directory
 function formatData(data: string, pkg: Manifest): string {
+  const prefix = `$PKG_HOME/opt/${pkg.name}/${pkg.version}`;
   return data
     .replaceAll("{{ version }}", pkg.version)
-    .replaceAll("{{ pkg.bin_dir }}", "$PKG_HOME/bin")
-    .replaceAll("{{ pkg.opt_dir }}", "$PKG_HOME/opt")
+    .replaceAll("{{ pkg.bin_dir }}", `${prefix}/bin`)
+    .replaceAll("{{ pkg.opt_dir }}", `${prefix}/opt`)
     .replaceAll("{{ pkg.tmp_dir }}", "$PKG_HOME/tmp")
     .replaceAll(
       "{{ pkg.completions.zsh }}",
-      "$PKG_HOME/share/zsh/site-functions",
+      `${prefix}/share/zsh/site-functions`,
     );
 }
 
@@ -89,7 +93,12 @@ ${formatData(pkg.scripts.completions[platform]!.join("\n"), pkg)}
 
   const dependencies = pkg.dependencies
     ? `Dependencies:
-${pkg.dependencies.map((dep) => `- [${dep}](./${dep}.md)`).join("\n")}
+${pkg.dependencies
+  .map((dep) => {
+    const name = dep.split(/[\s<>=!~^]/)[0]!;
+    return `- [${dep}](./${name}.md)`;
+  })
+  .join("\n")}
 `
     : "";
 